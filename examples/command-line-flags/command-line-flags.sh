@@ -42,10 +42,14 @@ tail: [a1 a2 a3 -numb=7]
 # generated help text for the command-line program.
 $ ./command-line-flags -h
 Usage of ./command-line-flags:
-  -fork=false: a bool
-  -numb=42: an int
-  -svar="bar": a string var
-  -word="foo": a string
+  -fork
+    	a bool
+  -numb int
+    	an int (default 42)
+  -svar string
+    	a string var (default "bar")
+  -word string
+    	a string (default "foo")
 
 # If you provide a flag that wasn't specified to the
 # `flag` package, the program will print an error message
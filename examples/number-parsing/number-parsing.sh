@@ -4,6 +4,6 @@ $ go run number-parsing.go
 456
 789
 135
-strconv.ParseInt: parsing "wat": invalid syntax
+strconv.Atoi: parsing "wat": invalid syntax
 
 # Next we'll look at another common parsing task: URLs.
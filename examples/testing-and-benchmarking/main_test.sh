@@ -1,6 +1,6 @@
 # Run all tests in the current project in verbose mode.
 $ go test -v
-== RUN   TestIntMinBasic
+=== RUN   TestIntMinBasic
 --- PASS: TestIntMinBasic (0.00s)
 === RUN   TestIntMinTableDriven
 === RUN   TestIntMinTableDriven/0,1
@@ -23,7 +23,7 @@ ok  	examples/testing-and-benchmarking	0.023s
 $ go test -bench=.
 goos: darwin
 goarch: arm64
-pkg: examples/testing
+pkg: examples/testing-and-benchmarking
 BenchmarkIntMin-8 1000000000 0.3136 ns/op
 PASS
 ok  	examples/testing-and-benchmarking	0.351s
@@ -1,6 +1,6 @@
 $ go run time-formatting-parsing.go 
 2014-04-15T18:00:15-07:00
-2012-11-01 22:08:41 +0000 +0000
+2012-11-01 22:08:41 +0000 UTC
 6:00PM
 Tue Apr 15 18:00:15 2014
 2014-04-15T18:00:15.161182-07:00
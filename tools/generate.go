@@ -1,13 +1,36 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
+	"unicode/utf8"
 
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/mmcgrana/gobyexample/tools/internal/examplelist"
+	"github.com/mmcgrana/gobyexample/tools/internal/filewatch"
+	"github.com/mmcgrana/gobyexample/tools/internal/textdiff"
 	"github.com/russross/blackfriday/v2"
 )
 
@@ -16,58 +39,402 @@ import (
 // program.
 var siteDir = "./public"
 
+// chromaStyle 是代码高亮使用的 chroma 样式名。为空时只输出 CSS 类名，
+// 颜色完全由 templates/site.css 决定；否则会把该样式生成的 CSS 追加到 site.css 末尾。
+var chromaStyle = ""
+
+// shareURL 是 Go Playground 的"分享"接口，用于为示例代码生成 Run 按钮的链接。
+// 可以指向本地的替身服务器以便测试。
+var shareURL = "https://play.golang.org/share"
+
+// refreshHashes 为 true 时，会把源码已变化的示例重新提交到 shareURL 并改写对应的 .hash 文件。
+var refreshHashes = false
+
+// warnStaleHashes 为 true 时，.hash 过期只打印警告而不让生成失败。
+var warnStaleHashes = false
+
+// Naming 决定示例页面的输出文件名，以及页面之间互相链接时使用的地址。
+// 生成器、模版、tools/serve 与 tools/upload 都遵循同一套规则。
+type Naming string
+
+const (
+	namingBare Naming = "bare" // public/json，链接为 json；线上站点使用这种方式
+	namingHTML Naming = "html" // public/json.html，链接为 json.html；可以直接用浏览器打开文件浏览
+	namingDir  Naming = "dir"  // public/json/index.html，链接为 json/
+)
+
+// naming 是通过 -naming 指定的命名方式。
+var naming = namingBare
+
+func parseNaming(s string) (Naming, error) {
+	switch n := Naming(s); n {
+	case namingBare, namingHTML, namingDir:
+		return n, nil
+	}
+	return "", fmt.Errorf("unknown naming %q (want %s, %s or %s)", s, namingBare, namingHTML, namingDir)
+}
+
+// File 返回页面 id 相对于站点目录的输出路径。
+func (n Naming) File(id string) string {
+	switch n {
+	case namingHTML:
+		return id + ".html"
+	case namingDir:
+		return id + "/index.html"
+	}
+	return id
+}
+
+// Href 返回从站点根目录链接到页面 id 的相对地址。
+func (n Naming) Href(id string) string {
+	switch n {
+	case namingHTML:
+		return id + ".html"
+	case namingDir:
+		return id + "/"
+	}
+	return id
+}
+
+// Root 返回从示例页面回到站点根目录的相对地址，页面中引用的 CSS、图片和其他页面都以它为前缀。
+func (n Naming) Root() string {
+	if n == namingDir {
+		return "../"
+	}
+	return ""
+}
+
+// Locale 描述站点的一种语言版本
+type Locale struct {
+	Code     string // 输出子目录名，同时也是翻译文件的后缀，如 hello-world.go.zh
+	HrefLang string // <html lang> 与 <link hreflang> 使用的语言标签
+	Label    string // 语言切换链接上显示的文字
+	// UntranslatedNote 是示例没有翻译、回退到英文时在页面上给出的提示
+	UntranslatedNote string
+}
+
+// defaultLocale 是源码本身（没有后缀的文件）使用的语言，也是翻译缺失时的回退语言。
+const defaultLocale = "en"
+
+var knownLocales = map[string]Locale{
+	"en": {Code: "en", HrefLang: "en", Label: "English"},
+	"zh": {Code: "zh", HrefLang: "zh-CN", Label: "中文", UntranslatedNote: "本示例还没有翻译，以下是英文原文。"},
+}
+
+// locales 是通过 -locales 指定的语言列表。为空时只生成一棵不分语言的目录树（即原来的 public/ 结构）。
+var locales []Locale
+
+// Alternate 是同一页面在另一种语言下的地址，用于语言切换链接和 hreflang。
+type Alternate struct {
+	Locale  Locale
+	Href    string
+	Current bool
+}
+
+func parseLocales(list string) ([]Locale, error) {
+	var result []Locale
+	for _, code := range strings.Split(list, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		locale, ok := knownLocales[code]
+		if !ok {
+			return nil, fmt.Errorf("unknown locale %q", code)
+		}
+		result = append(result, locale)
+	}
+	return result, nil
+}
+
+// alternates 返回 page（如 "json" 或 ""，相对于语言目录）在各语言目录下的地址，
+// root 是从当前页面回到所在语言目录的相对地址。
+func alternates(current Locale, root, page string) []Alternate {
+	var result []Alternate
+	for _, locale := range locales {
+		result = append(result, Alternate{
+			Locale:  locale,
+			Href:    root + "../" + locale.Code + "/" + page,
+			Current: locale.Code == current.Code,
+		})
+	}
+	return result
+}
+
+// localizedSource 返回 sourcePath 在指定语言下的翻译文件；翻译不存在时回退到原文件，并返回 false。
+func localizedSource(sourcePath string, locale Locale) (string, bool) {
+	if locale.Code == "" || locale.Code == defaultLocale {
+		return sourcePath, true
+	}
+	translated := sourcePath + "." + locale.Code
+	if _, err := os.Stat(translated); err == nil {
+		return translated, true
+	}
+	return sourcePath, false
+}
+
 func verbose() bool {
 	return len(os.Getenv("VERBOSE")) > 0
 }
 
-func check(err error) {
-	if err != nil {
-		panic(err)
+// BuildError 是生成过程中发现的一个问题。Path 与 Line 指向出问题的文件和行，Line 为 0 表示无法确定具体的行。
+type BuildError struct {
+	Path string
+	Line int
+	Err  error
+}
+
+func (e *BuildError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %v", e.Path, e.Line, e.Err)
 	}
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
 }
 
-func ensureDir(dir string) {
-	err := os.MkdirAll(dir, 0755)
-	check(err)
+func (e *BuildError) Unwrap() error {
+	return e.Err
 }
 
-func copyFile(src, dst string) {
+// BuildErrors 收集一次生成过程中的全部问题，这样一个示例出错不会掩盖其他示例的问题。
+type BuildErrors []*BuildError
+
+func (errs BuildErrors) Error() string {
+	var lines []string
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Add 记录一个位于 path 第 line 行的问题。
+func (errs *BuildErrors) Add(path string, line int, err error) {
+	*errs = append(*errs, &BuildError{Path: path, Line: line, Err: err})
+}
+
+// AddErr 记录 err。如果 err 本身已经带有位置（BuildError 或文件操作的 PathError），就沿用其中的位置，否则归到 path 名下。
+func (errs *BuildErrors) AddErr(path string, err error) {
+	var buildErr *BuildError
+	var pathErr *fs.PathError
+	switch {
+	case errors.As(err, &buildErr):
+		*errs = append(*errs, buildErr)
+	case errors.As(err, &pathErr):
+		errs.Add(pathErr.Path, 0, fmt.Errorf("%s: %v", pathErr.Op, pathErr.Err))
+	default:
+		errs.Add(path, 0, err)
+	}
+}
+
+// templatePosPat 匹配 text/template 错误信息开头的 "template: 名称:行号:"
+var templatePosPat = regexp.MustCompile(`^template: ([^:]+):(\d+):(\d+:)?`)
+
+// templateError 把模版的解析或执行错误转换成指向模版文件与行号的 BuildError。
+// 模版以文件路径命名（见 parseTemplates），所以错误信息里的名称就是出错的文件。
+func templateError(path string, err error) *BuildError {
+	m := templatePosPat.FindStringSubmatch(err.Error())
+	if m == nil {
+		return &BuildError{Path: path, Err: err}
+	}
+	line, _ := strconv.Atoi(m[2])
+	if strings.Contains(m[1], "/") {
+		path = m[1]
+	}
+	msg := strings.TrimSpace(strings.TrimPrefix(err.Error(), m[0]))
+	return &BuildError{Path: path, Line: line, Err: errors.New(msg)}
+}
+
+// siteOutput 是生成结果的去处：通常直接写入磁盘，-check 模式下则留在内存中以便与 siteDir 比较。
+var siteOutput output = dirOutput{}
+
+type output interface {
+	WriteFile(path string, data []byte) error
+}
+
+// dirOutput 把文件写到磁盘上，并按需创建所在的目录。
+type dirOutput struct{}
+
+func (dirOutput) WriteFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// memOutput 把文件内容按路径保存在内存中，可以被多个 goroutine 同时写入。
+type memOutput struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newMemOutput() *memOutput {
+	return &memOutput{files: make(map[string][]byte)}
+}
+
+func (m *memOutput) WriteFile(path string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[filepath.Clean(path)] = data
+	return nil
+}
+
+func copyFile(src, dst string) error {
 	dat, err := os.ReadFile(src)
-	check(err)
-	err = os.WriteFile(dst, dat, 0644)
-	check(err)
+	if err != nil {
+		return err
+	}
+	return siteOutput.WriteFile(dst, dat)
 }
 
-func mustReadFile(path string) string {
+func readFile(path string) (string, error) {
 	bytes, err := os.ReadFile(path)
-	check(err)
-	return string(bytes)
+	return string(bytes), err
 }
 
 func markdown(src string) string {
 	return string(blackfriday.Run([]byte(src)))
 }
 
-func readLines(path string) []string {
-	src := mustReadFile(path)
-	return strings.Split(src, "\n")
-}
-
-func mustGlob(glob string) []string {
-	paths, err := filepath.Glob(glob)
-	check(err)
-	return paths
+func readLines(path string) ([]string, error) {
+	src, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(src, "\n"), nil
 }
 
-func whichLexer(path string) string {
+func whichLexer(path string) (string, error) {
+	// 翻译文件带有语言后缀，如 hello-world.go.zh
+	for code := range knownLocales {
+		path = strings.TrimSuffix(path, "."+code)
+	}
 	if strings.HasSuffix(path, ".go") {
-		return "go"
+		return "go", nil
 	} else if strings.HasSuffix(path, ".sh") {
-		return "console"
+		return "console", nil
+	}
+	return "", fmt.Errorf("no lexer for %s files", filepath.Ext(path))
+}
+
+// SimpleShellOutputLexer 用于 .sh 文件：只识别"$"提示符，其余内容都当作命令的输出。
+var SimpleShellOutputLexer = chroma.MustNewLexer(
+	&chroma.Config{
+		Name:      "Shell Output",
+		Aliases:   []string{"console"},
+		Filenames: []string{"*.sh"},
+		MimeTypes: []string{},
+	},
+	chroma.Rules{
+		"root": {
+			// "$" 或 ">" 表示提示符的开始
+			{Pattern: `^\$`, Type: chroma.GenericPrompt, Mutator: chroma.Push("prompt")},
+			{Pattern: `^>`, Type: chroma.GenericPrompt, Mutator: chroma.Push("prompt")},
+
+			// 空行就是普通文本
+			{Pattern: `^$\n`, Type: chroma.Text},
+
+			// 其余的都是输出
+			{Pattern: `[^\n]+$\n?`, Type: chroma.GenericOutput},
+		},
+		"prompt": {
+			// 遇到换行后按输出的规则处理
+			{Pattern: `\n`, Type: chroma.Text, Mutator: chroma.Push("output")},
+			// 否则都是命令本身
+			{Pattern: `[^\n]+$`, Type: chroma.Text},
+		},
+		"output": {
+			// 一条命令的输出之后可能紧跟着下一个提示符
+			{Pattern: `^\$`, Type: chroma.GenericPrompt, Mutator: chroma.Pop(1)},
+			{Pattern: `^>`, Type: chroma.GenericPrompt, Mutator: chroma.Pop(1)},
+			// 空行就是普通文本
+			{Pattern: `^$\n`, Type: chroma.Text},
+			// 其余的都是输出
+			{Pattern: `[^\n]+$\n?`, Type: chroma.GenericOutput},
+		},
+	},
+)
+
+func chromaLexer(lexerName string) chroma.Lexer {
+	var lexer chroma.Lexer
+	if lexerName == "console" {
+		lexer = SimpleShellOutputLexer
 	} else {
-		return "hash"
+		lexer = lexers.Get(lexerName)
 	}
-	//panic("No lexer for " + path)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+func chromaFormatter() *html.Formatter {
+	return html.New(html.WithClasses(true))
+}
+
+// chromaFormat 将代码高亮为带有 CSS 类名的 HTML（<pre class="chroma">…</pre>）。
+func chromaFormat(code, lexerName string) (string, error) {
+	iterator, err := chromaLexer(lexerName).Tokenise(nil, code)
+	if err != nil {
+		return "", err
+	}
+	buf := new(bytes.Buffer)
+	err = chromaFormatter().Format(buf, styles.Get(chromaStyle), iterator)
+	return buf.String(), err
+}
+
+// writeSiteCSS 复制 templates/site.css；如果指定了 chroma 样式，则在末尾追加该样式的高亮规则。
+func writeSiteCSS(dst string) error {
+	css, err := readFile("templates/site.css")
+	if err != nil {
+		return err
+	}
+	if chromaStyle != "" {
+		buf := new(bytes.Buffer)
+		if err := chromaFormatter().WriteCSS(buf, styles.Get(chromaStyle)); err != nil {
+			return err
+		}
+		css += "\n/* Syntax highlighting: " + chromaStyle + " */\n" + buf.String()
+	}
+	return siteOutput.WriteFile(dst, []byte(css))
+}
+
+func sha1Sum(s string) string {
+	h := sha1.New()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// parseHashFile 读取 .hash 文件：第一行是 Go 源码的 SHA1，第二行是 Playground 的分享 ID。
+func parseHashFile(sourcePath string) (string, string, error) {
+	lines, err := readLines(sourcePath)
+	if err != nil {
+		return "", "", err
+	}
+	if len(lines) < 2 {
+		return strings.TrimSpace(lines[0]), "", nil
+	}
+	return strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1]), nil
+}
+
+// resetURLHashFile 将代码提交到 shareURL，并用新的源码哈希和分享 ID 改写 .hash 文件。
+func resetURLHashFile(codeHash, code, hashPath string) (string, error) {
+	if verbose() {
+		fmt.Printf("  Sending request to %s\n", shareURL)
+	}
+	resp, err := http.Post(shareURL, "text/plain; charset=utf-8", strings.NewReader(code))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s: %s", shareURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	urlHash := strings.TrimSpace(string(body))
+	data := fmt.Sprintf("%s\n%s\n", codeHash, urlHash)
+	return urlHash, os.WriteFile(hashPath, []byte(data), 0644)
 }
 
 func debug(msg string) {
@@ -80,8 +447,8 @@ func debug(msg string) {
 	}
 }
 
-// 短破折号 —— "-"
-var dashPat = regexp.MustCompile(`-+`)
+// 注释行：Go 源码中以 "// " 开头，Shell 脚本中以 "# " 开头
+var docsPat = regexp.MustCompile(`^\s*(\/\/|#)\s`)
 
 // Seg is a segment of an example
 type Seg struct {
@@ -92,25 +459,155 @@ type Seg struct {
 
 // Example is info extracted from an example file
 type Example struct {
-	ID, Name    string
-	RealName    string // 渲染首页列表时需要的"中文"名称
-	Html        string // 内容等于 Segs 中 DocsRendered 字段的集合；否则在渲染模版时就会出现"分段"并产生重复的 HTML 元素。
-	GoCode      string
-	GoCodeHash  string
-	URLHash     string
-	Segs        [][]*Seg
-	PrevExample *Example
-	NextExample *Example
-}
-
-func parseSegs(sourcePath string) ([]*Seg, string) {
+	ID, Name     string
+	RealName     string // 页面上显示的名称：中文站点为 examples.txt 中"|"之后的部分，英文站点等于 Name
+	Href         string // 从站点根目录链接到本页面的地址，见 Naming
+	Root         string // 从本页面回到站点根目录的地址
+	GoCode       string
+	GoCodeHash   string
+	URLHash      string
+	Segs         [][]*Seg
+	PrevExample  *Example
+	NextExample  *Example
+	Locale       Locale
+	Alternates   []Alternate
+	Untranslated bool // 当前语言下没有任何翻译文件，页面内容回退到了英文
+
+	sourcePaths []string // examples/<ID>/ 下的全部文件，包括 .hash 和翻译文件
+}
+
+// Index 是渲染首页所需的数据
+type Index struct {
+	Examples   []*Example
+	Locale     Locale
+	Alternates []Alternate
+}
+
+// jobs 是并发渲染示例页面的 goroutine 数量
+var jobs = runtime.NumCPU()
+
+// Manifest 记录上一次生成时每个示例页面的输入哈希（源码、模版、examples.txt 中的相关条目以及生成器本身）
+// 和输出哈希。输入没有变化、输出文件也没有被改动（例如 git checkout public/ 或切换分支）的页面就不必重新生成。
+type Manifest struct {
+	path    string
+	Inputs  map[string]string // 输出文件 -> 输入哈希
+	Outputs map[string]string // 输出文件 -> 写入内容的哈希
+}
+
+// manifestPath 返回 dir 对应的清单文件。清单放在用户的缓存目录中，而不是站点目录里，以免被提交或上传。
+func manifestPath(dir string) (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gobyexample", sha1Sum(abs)+".json"), nil
+}
+
+// loadManifest 读取 dir 上一次生成时的清单；force 为 true、清单不存在或无法读取时返回一个空清单，所有页面都会重新生成。
+func loadManifest(dir string, force bool) *Manifest {
+	manifest := &Manifest{Inputs: make(map[string]string), Outputs: make(map[string]string)}
+	path, err := manifestPath(dir)
+	if err != nil {
+		return manifest
+	}
+	manifest.path = path
+	if force {
+		return manifest
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, manifest); err != nil || manifest.Inputs == nil || manifest.Outputs == nil {
+			manifest.Inputs = make(map[string]string)
+			manifest.Outputs = make(map[string]string)
+		}
+	}
+	return manifest
+}
+
+func (m *Manifest) upToDate(output, inputHash string) bool {
+	if m.Inputs[output] != inputHash {
+		return false
+	}
+	data, err := os.ReadFile(output)
+	return err == nil && sha1Sum(string(data)) == m.Outputs[output]
+}
+
+func (m *Manifest) record(output, inputHash string, data []byte) {
+	m.Inputs[output] = inputHash
+	m.Outputs[output] = sha1Sum(string(data))
+}
+
+func (m *Manifest) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(m.path, data, 0644)
+}
+
+// generatorInputs 是所有示例页面共同的输入：生成器源码、示例模版和影响输出的参数。
+// go.mod 和 go.sum 决定了 chroma、blackfriday 等依赖的版本，升级它们同样会改变输出。
+var generatorInputs = []string{
+	"tools/generate.go", "tools/internal/examplelist/examplelist.go",
+	"templates/example.tmpl", "templates/footer.tmpl",
+	"go.mod", "go.sum",
+}
+
+// exampleInputHash 计算示例页面全部输入的哈希。除了示例目录下的文件，前后示例的名称也会出现在页面上。
+func exampleInputHash(example *Example) (string, error) {
+	h := sha1.New()
+	for _, path := range generatorInputs {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", path, len(data))
+		h.Write(data)
+	}
+	var localeCodes []string
+	for _, locale := range locales {
+		localeCodes = append(localeCodes, locale.Code)
+	}
+	fmt.Fprintf(h, "go=%s style=%s locales=%s warn-stale=%t\n", runtime.Version(), chromaStyle, strings.Join(localeCodes, ","), warnStaleHashes)
+	fmt.Fprintf(h, "%s|%s|%s|%s\n", example.ID, example.Name, example.RealName, example.Locale.Code)
+	if example.PrevExample != nil {
+		fmt.Fprintf(h, "prev %s|%s\n", example.PrevExample.ID, example.PrevExample.RealName)
+	}
+	if example.NextExample != nil {
+		fmt.Fprintf(h, "next %s|%s\n", example.NextExample.ID, example.NextExample.RealName)
+	}
+	for _, path := range example.sourcePaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %d\n", path, len(data))
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func parseSegs(sourcePath string) ([]*Seg, string, error) {
 	var (
 		lines  []string
 		source []string
 		segs   []*Seg
 	)
+	srcLines, err := readLines(sourcePath)
+	if err != nil {
+		return nil, "", err
+	}
 	// 将 tab 转换为4个空格以统一风格
-	for _, line := range readLines(sourcePath) {
+	for _, line := range srcLines {
 		lines = append(lines, strings.Replace(line, "\t", "    ", -1))
 		source = append(source, line)
 	}
@@ -124,44 +621,78 @@ func parseSegs(sourcePath string) ([]*Seg, string) {
 			lastSeen = ""
 			continue
 		}
-		// 如果匹配到了"Go 注释"，那就说明不是"Go 代码"；所以这里对 matchDocs 取反
+		// 如果匹配到了"Go 注释"或"Shell 注释"，那就说明不是"代码"；所以这里对 matchDocs 取反
+		matchDocs := docsPat.MatchString(line)
+		matchCode := !matchDocs
 		newDocs := (lastSeen == "") || ((lastSeen != "docs") && (segs[len(segs)-1].Docs != ""))
-		if newDocs {
+		newCode := (lastSeen == "") || ((lastSeen != "code") && (segs[len(segs)-1].Code != ""))
+		if newDocs || newCode {
 			debug("NEWSEG")
 		}
 
-		if newDocs {
-			newSeg := Seg{Docs: line, Code: ""}
-			segs = append(segs, &newSeg)
-		} else {
-			segs[len(segs)-1].Docs = segs[len(segs)-1].Docs + "\n" + line
+		if matchDocs {
+			trimmed := docsPat.ReplaceAllString(line, "")
+			if newDocs {
+				newSeg := Seg{Docs: trimmed, Code: ""}
+				segs = append(segs, &newSeg)
+			} else {
+				segs[len(segs)-1].Docs = segs[len(segs)-1].Docs + "\n" + trimmed
+			}
+			debug("DOCS: " + line)
+			lastSeen = "docs"
+		} else if matchCode {
+			if newCode {
+				newSeg := Seg{Docs: "", Code: line}
+				segs = append(segs, &newSeg)
+			} else {
+				lastSeg := segs[len(segs)-1]
+				// 代码块内部的空行需要保留
+				if len(lastSeen) == 0 {
+					lastSeg.Code = lastSeg.Code + "\n"
+				}
+				lastSeg.Code = lastSeg.Code + "\n" + line
+			}
+			debug("CODE: " + line)
+			lastSeen = "code"
 		}
-
-		debug("DOCS: " + line)
-		lastSeen = "docs"
 	}
-	for _, seg := range segs {
-		seg.CodeEmpty = true
-		seg.CodeLeading = false
-		seg.CodeRun = false
+	for i, seg := range segs {
+		seg.CodeEmpty = seg.Code == ""
+		seg.CodeLeading = i < (len(segs) - 1)
+		seg.CodeRun = strings.Contains(seg.Code, "package main")
 	}
-	return segs, fileContent
+	return segs, fileContent, nil
 }
 
-func parseAndRenderSegs(sourcePath string) ([]*Seg, string) {
-	segs, fileContent := parseSegs(sourcePath)
+func parseAndRenderSegs(sourcePath string) ([]*Seg, string, error) {
+	segs, fileContent, err := parseSegs(sourcePath)
+	if err != nil {
+		return nil, "", err
+	}
 
-	// 根据文件名的后缀决定使用什么语法分析器：go 或 shell script；
-	// 但是目前仅能作为检查文件的后缀名了
-	whichLexer(sourcePath)
+	// 根据文件名的后缀决定使用什么语法分析器：go 或 shell script
+	lexer, err := whichLexer(sourcePath)
+	if err != nil {
+		return nil, "", err
+	}
 
 	for _, seg := range segs {
 		if seg.Docs != "" {
 			seg.DocsRendered = markdown(seg.Docs)
 		}
+		if seg.Code != "" {
+			seg.CodeRendered, err = chromaFormat(seg.Code, lexer)
+			if err != nil {
+				return nil, "", err
+			}
+			// 供"复制代码"按钮使用的 JS 内容，只需要 Go 代码
+			if lexer == "go" {
+				seg.CodeForJs = strings.Trim(seg.Code, "\n") + "\n"
+			}
+		}
 	}
 
-	return segs, fileContent
+	return segs, fileContent, nil
 }
 
 // splitExampleName 文件 examples.txt 中的每一行都是以"英文文件名｜中文"的格式保存，这是为了在渲染首页时能灵活显示标题。
@@ -175,42 +706,82 @@ func splitExampleName(name string) []string {
 	return splitNames
 }
 
-func parseExamples() []*Example {
-	var exampleNames []string
+// validateExamples 检查 examples.txt 与 examples/ 目录是否一致：
+// 条目没有对应的目录、目录没有列在 examples.txt 中、目录缺少 .go/.sh/.hash 文件，以及规范化后重复的 ID。
+func validateExamples(errs *BuildErrors) {
+	entries, err := examplelist.Entries()
+	if err != nil {
+		errs.AddErr("examples.txt", err)
+		return
+	}
+	listed := make(map[string]int) // ID -> 首次出现的行号
+	for _, entry := range entries {
+		id := examplelist.ID(splitExampleName(entry.Name)[0])
+		if line, ok := listed[id]; ok {
+			errs.Add("examples.txt", entry.Line, fmt.Errorf("%q: duplicate example ID %q (first listed on line %d)", entry.Name, id, line))
+			continue
+		}
+		listed[id] = entry.Line
+		dir := "examples/" + id
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			errs.Add("examples.txt", entry.Line, fmt.Errorf("%q: no example directory %s", entry.Name, dir))
+			continue
+		}
+		for _, ext := range []string{".go", ".sh", ".hash"} {
+			if matches, _ := filepath.Glob(dir + "/*" + ext); len(matches) == 0 {
+				errs.Add(dir, 0, fmt.Errorf("no %s file", ext))
+			}
+		}
+	}
 
-	for _, line := range readLines("examples.txt") {
-		if line != "" && !strings.HasPrefix(line, "#") {
-			exampleNames = append(exampleNames, line)
+	dirs, err := os.ReadDir("examples")
+	if err != nil {
+		errs.AddErr("examples", err)
+		return
+	}
+	for _, dir := range dirs {
+		if _, ok := listed[dir.Name()]; dir.IsDir() && !ok {
+			errs.Add("examples/"+dir.Name(), 0, errors.New("not listed in examples.txt"))
 		}
 	}
+}
+
+// loadExamples 读取 examples.txt 中列出的全部示例，确定它们的名称、前后链接和源文件，但还不解析源码。
+// 没有对应目录的条目会被记录到 errs 中并跳过。
+func loadExamples(locale Locale, errs *BuildErrors) []*Example {
+	entries, err := examplelist.Entries()
+	if err != nil {
+		errs.AddErr("examples.txt", err)
+		return nil
+	}
 
 	examples := make([]*Example, 0)
-	for i, exampleName := range exampleNames {
-		if verbose() {
-			fmt.Printf("Processing %s [%d/%d]\n", exampleName, i+1, len(exampleNames))
-		}
-		splitNames := splitExampleName(exampleName)
+	for _, entry := range entries {
+		splitNames := splitExampleName(entry.Name)
 		example := Example{
 			Name:     splitNames[0],
 			RealName: splitNames[1],
+			Locale:   locale,
 		}
-		exampleID := strings.ToLower(splitNames[0])
-		exampleID = strings.Replace(exampleID, " ", "-", -1)
-		exampleID = strings.Replace(exampleID, "/", "-", -1)
-		exampleID = strings.Replace(exampleID, "'", "", -1)
-		exampleID = dashPat.ReplaceAllString(exampleID, "-")
-		example.ID = exampleID
-		example.Segs = make([][]*Seg, 0)
-		sourcePaths := mustGlob("examples/" + exampleID + "/*.md")
-		for _, sourcePath := range sourcePaths {
-			sourceSegs, fileContents := parseAndRenderSegs(sourcePath)
-			if fileContents != "" {
-				example.GoCode = fileContents
-			}
-			example.Segs = append(example.Segs, sourceSegs)
-			example.Html = markdown(fileContents)
+		if locale.Code == defaultLocale {
+			example.RealName = example.Name
+		}
+		example.ID = examplelist.ID(splitNames[0])
+		example.Href = naming.Href(example.ID)
+		example.Root = naming.Root()
+		exampleDir := "examples/" + example.ID
+		if info, err := os.Stat(exampleDir); err != nil || !info.IsDir() {
+			errs.Add("examples.txt", entry.Line, fmt.Errorf("%q: no example directory %s", entry.Name, exampleDir))
+			continue
+		}
+		example.sourcePaths, err = filepath.Glob(exampleDir + "/*")
+		if err != nil {
+			errs.AddErr(exampleDir, err)
+			continue
+		}
+		if len(locales) > 0 {
+			example.Alternates = alternates(locale, example.Root, example.Href)
 		}
-
 		examples = append(examples, &example)
 	}
 
@@ -226,51 +797,457 @@ func parseExamples() []*Example {
 	return examples
 }
 
-func renderIndex(examples []*Example) {
+// parseExample 解析示例的源码与 .hash 文件，填充 Segs、GoCode 等字段。返回 false 表示示例有错误，不能渲染。
+func parseExample(example *Example, errs *BuildErrors) bool {
+	var err error
+	example.Segs = make([][]*Seg, 0)
+	failed := false
+	translatedAny := false
+	hashPath := "examples/" + example.ID + "/" + example.ID + ".hash"
+	for _, sourcePath := range example.sourcePaths {
+		// .hash 文件不是需要渲染的源码
+		if strings.HasSuffix(sourcePath, ".hash") {
+			hashPath = sourcePath
+			example.GoCodeHash, example.URLHash, err = parseHashFile(sourcePath)
+			if err != nil {
+				errs.AddErr(sourcePath, err)
+				failed = true
+			}
+			continue
+		}
+		// 翻译文件（如 hello-world.go.zh）在处理对应的原文件时才会用到
+		if !strings.HasSuffix(sourcePath, ".go") && !strings.HasSuffix(sourcePath, ".sh") {
+			continue
+		}
+		// Playground 上运行的始终是原文代码
+		if strings.HasSuffix(sourcePath, ".go") {
+			example.GoCode, err = readFile(sourcePath)
+			if err != nil {
+				errs.AddErr(sourcePath, err)
+				failed = true
+				continue
+			}
+		}
+		localPath, translated := localizedSource(sourcePath, example.Locale)
+		translatedAny = translatedAny || translated
+		sourceSegs, _, err := parseAndRenderSegs(localPath)
+		if err != nil {
+			errs.AddErr(localPath, err)
+			failed = true
+			continue
+		}
+		example.Segs = append(example.Segs, sourceSegs)
+	}
+	if failed {
+		return false
+	}
+	example.Untranslated = !translatedAny
+
+	// 源码变了但 .hash 没有更新，说明 Run 按钮指向的还是旧代码
+	newCodeHash := sha1Sum(example.GoCode)
+	if example.GoCodeHash != newCodeHash {
+		switch {
+		case refreshHashes:
+			example.GoCodeHash = newCodeHash
+			example.URLHash, err = resetURLHashFile(newCodeHash, example.GoCode, hashPath)
+			if err != nil {
+				errs.AddErr(hashPath, err)
+				return false
+			}
+		case warnStaleHashes:
+			fmt.Fprintf(os.Stderr, "warning: %s:1: stale playground hash; run tools/generate -refresh-hashes\n", hashPath)
+		default:
+			errs.Add(hashPath, 1, errors.New("stale playground hash; run tools/generate -refresh-hashes"))
+			return false
+		}
+	}
+	return true
+}
+
+// parseTemplates 解析 main 以及它引用的其他模版文件。每个模版都以文件路径命名，
+// 这样解析或执行出错时，错误信息能定位到具体的文件和行。
+func parseTemplates(main string, others ...string) (*template.Template, error) {
+	tmpl := template.New(main)
+	for _, path := range append(others, main) {
+		src, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		t := tmpl
+		if path != main {
+			t = tmpl.New(path)
+		}
+		if _, err := t.Parse(src); err != nil {
+			return nil, templateError(path, err)
+		}
+	}
+	return tmpl, nil
+}
+
+// renderTemplate 渲染 tmpl，返回生成的内容。
+func renderTemplate(tmpl *template.Template, data interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return nil, templateError(tmpl.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// executeTemplate 将 tmpl 渲染到 path 文件中。
+func executeTemplate(tmpl *template.Template, path string, data interface{}) error {
+	page, err := renderTemplate(tmpl, data)
+	if err != nil {
+		return err
+	}
+	return siteOutput.WriteFile(path, page)
+}
+
+func renderIndex(dir string, index *Index) error {
 	if verbose() {
 		fmt.Println("Rendering index")
 	}
-	indexTmpl := template.New("index")
-	_, err := indexTmpl.Parse(mustReadFile("templates/footer.tmpl"))
-	check(err)
-	_, err = indexTmpl.Parse(mustReadFile("templates/index.tmpl"))
-	check(err)
-	indexF, err := os.Create(siteDir + "/index.html")
-	check(err)
-	err = indexTmpl.Execute(indexF, examples)
-	check(err)
+	indexTmpl, err := parseTemplates("templates/index.tmpl", "templates/footer.tmpl")
+	if err != nil {
+		return err
+	}
+	return executeTemplate(indexTmpl, dir+"/index.html", index)
 }
 
-func renderExamples(examples []*Example) {
-	if verbose() {
-		fmt.Println("Rendering examples")
+// renderExamples 解析并渲染 examples 中的示例页面。输入没有变化的页面（见 Manifest）会被跳过，
+// 其余页面由 jobs 个 goroutine 并发处理。
+func renderExamples(dir string, examples []*Example, manifest *Manifest, errs *BuildErrors) int {
+	exampleTmpl, err := parseTemplates("templates/example.tmpl", "templates/footer.tmpl")
+	if err != nil {
+		errs.AddErr("templates/example.tmpl", err)
+		return 0
 	}
-	exampleTmpl := template.New("example")
-	_, err := exampleTmpl.Parse(mustReadFile("templates/footer.tmpl"))
-	check(err)
-	_, err = exampleTmpl.Parse(mustReadFile("templates/example.tmpl"))
-	check(err)
+
+	var dirty []*Example
+	inputs := make(map[*Example]string)
 	for _, example := range examples {
-		exampleF, err := os.Create(siteDir + "/" + example.ID + ".html")
-		check(err)
-		err = exampleTmpl.Execute(exampleF, example)
-		check(err)
+		path := dir + "/" + naming.File(example.ID)
+		inputs[example], err = exampleInputHash(example)
+		if err != nil {
+			errs.AddErr("examples/"+example.ID, err)
+			continue
+		}
+		if manifest.upToDate(path, inputs[example]) {
+			continue
+		}
+		dirty = append(dirty, example)
+	}
+	if verbose() {
+		fmt.Printf("Rendering %d of %d examples\n", len(dirty), len(examples))
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		seen = make(map[string]bool) // 同一处模版错误通常会在每个示例上重复出现，只报告第一次
+	)
+	queue := make(chan *Example)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for example := range queue {
+				if verbose() {
+					fmt.Printf("Processing %s\n", example.ID)
+				}
+				var exampleErrs BuildErrors
+				path := dir + "/" + naming.File(example.ID)
+				ok := parseExample(example, &exampleErrs)
+				var page []byte
+				if ok {
+					var err error
+					page, err = renderTemplate(exampleTmpl, example)
+					if err == nil {
+						err = siteOutput.WriteFile(path, page)
+					}
+					if err != nil {
+						ok = false
+						mu.Lock()
+						duplicate := seen[err.Error()]
+						seen[err.Error()] = true
+						mu.Unlock()
+						var buildErr *BuildError
+						if errors.As(err, &buildErr) {
+							// 注明是渲染哪个示例时出的错
+							buildErr.Err = fmt.Errorf("rendering %s: %v", example.ID, buildErr.Err)
+						}
+						if !duplicate {
+							exampleErrs.AddErr("templates/example.tmpl", err)
+						}
+					}
+				}
+				mu.Lock()
+				if ok {
+					manifest.record(path, inputs[example], page)
+				}
+				*errs = append(*errs, exampleErrs...)
+				mu.Unlock()
+			}
+		}()
 	}
+	for _, example := range dirty {
+		queue <- example
+	}
+	close(queue)
+	wg.Wait()
+	sort.SliceStable(*errs, func(i, j int) bool {
+		return (*errs)[i].Path < (*errs)[j].Path
+	})
+	return len(dirty)
+}
+
+// renderLocaleIndex 生成站点根目录下的首页，它只负责跳转到默认语言的首页。
+func renderLocaleIndex(dir string) error {
+	tmpl, err := parseTemplates("templates/locales.tmpl")
+	if err != nil {
+		return err
+	}
+	index := &Index{Locale: locales[0]}
+	for _, locale := range locales {
+		index.Alternates = append(index.Alternates, Alternate{Locale: locale, Href: locale.Code + "/"})
+	}
+	return executeTemplate(tmpl, dir+"/index.html", index)
+}
+
+// build 生成一棵完整的站点目录树，返回重新渲染的示例页面数；locale 为零值时表示不区分语言的单一站点。
+func build(dir string, locale Locale, manifest *Manifest, errs *BuildErrors) int {
+	if verbose() && locale.Code != "" {
+		fmt.Printf("Building %s site in %s\n", locale.Label, dir)
+	}
+	if err := writeSiteCSS(dir + "/site.css"); err != nil {
+		errs.AddErr("templates/site.css", err)
+	}
+	for _, name := range []string{"site.js", "favicon.ico", "404.html", "play.png", "clipboard.png"} {
+		if err := copyFile("templates/"+name, dir+"/"+name); err != nil {
+			errs.AddErr("templates/"+name, err)
+		}
+	}
+	examples := loadExamples(locale, errs)
+	index := &Index{Examples: examples, Locale: locale}
+	if len(locales) > 0 {
+		index.Alternates = alternates(locale, "", "")
+	}
+	if err := renderIndex(dir, index); err != nil {
+		errs.AddErr("templates/index.tmpl", err)
+	}
+	return renderExamples(dir, examples, manifest, errs)
+}
+
+// generateSite 按 locales 生成整个站点并保存清单，返回重新渲染的示例页面数以及遇到的问题。
+func generateSite(manifest *Manifest, saveManifest bool) (int, BuildErrors) {
+	var errs BuildErrors
+	rendered := 0
+	if len(locales) == 0 {
+		rendered = build(siteDir, Locale{}, manifest, &errs)
+	} else {
+		for _, locale := range locales {
+			rendered += build(siteDir+"/"+locale.Code, locale, manifest, &errs)
+		}
+		if err := renderLocaleIndex(siteDir); err != nil {
+			errs.AddErr("templates/locales.tmpl", err)
+		}
+		// 根目录下的未知路径也需要 404 页面，供 tools/serve 和存储桶的错误文档使用
+		if err := copyFile("templates/404.html", siteDir+"/404.html"); err != nil {
+			errs.AddErr("templates/404.html", err)
+		}
+	}
+	if saveManifest {
+		if err := manifest.save(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: can't save the build manifest: %v\n", err)
+		}
+	}
+	return rendered, errs
+}
+
+// watchedPaths 是会影响生成结果的输入
+var watchedPaths = []string{"examples", "templates", "examples.txt"}
+
+// watch 轮询 watchedPaths，在文件变化后重新生成站点。连续的多次写入（例如编辑器保存时）
+// 会等到一段时间内不再有变化才触发一次生成（见 filewatch.Wait）；得益于清单，每次只会重新渲染受影响的页面。
+func watch(manifest *Manifest) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	rebuild := func(reason string) {
+		start := time.Now()
+		rendered, errs := generateSite(manifest, true)
+		took := time.Since(start).Round(time.Millisecond)
+		stamp := start.Format("15:04:05")
+		if len(errs) > 0 {
+			fmt.Printf("%s %s: failed with %d problem(s) in %v\n", stamp, reason, len(errs), took)
+			for _, err := range errs {
+				fmt.Printf("  %v\n", err)
+			}
+			return
+		}
+		fmt.Printf("%s %s: rendered %d page(s) in %v\n", stamp, reason, rendered, took)
+	}
+
+	fmt.Printf("Watching %s; press Ctrl-C to stop\n", strings.Join(watchedPaths, ", "))
+	last := filewatch.Take(watchedPaths...)
+	rebuild("initial build")
+	for {
+		current, changed, err := filewatch.Wait(ctx, last, watchedPaths...)
+		if err != nil {
+			fmt.Println("done")
+			return
+		}
+		last = current
+		reason := changed[0]
+		if len(changed) > 1 {
+			reason = fmt.Sprintf("%s and %d more", changed[0], len(changed)-1)
+		}
+		rebuild(reason + " changed")
+	}
+}
+
+// reportErrors 打印 errs 中的全部问题，有问题时以非零状态退出。
+func reportErrors(errs BuildErrors, summary string) {
+	if len(errs) == 0 {
+		return
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	fmt.Fprintf(os.Stderr, "%d problem(s) found; %s\n", len(errs), summary)
+	os.Exit(1)
+}
+
+// checkSite 将内存中生成的站点与磁盘上的 dir 逐个文件比较，打印不一致的文件及其差异，返回不一致的文件数。
+func checkSite(dir string, generated map[string][]byte) int {
+	var paths []string
+	for path := range generated {
+		paths = append(paths, path)
+	}
+	onDisk := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			onDisk[filepath.Clean(path)] = true
+			if _, ok := generated[filepath.Clean(path)]; !ok {
+				paths = append(paths, filepath.Clean(path))
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	sort.Strings(paths)
+
+	differ := 0
+	for _, path := range paths {
+		want, ok := generated[path]
+		switch {
+		case !ok:
+			fmt.Printf("%s: not produced by the generator\n", path)
+			differ++
+			continue
+		case !onDisk[path]:
+			fmt.Printf("%s: missing; the generator produces it\n", path)
+			differ++
+			continue
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			differ++
+			continue
+		}
+		if bytes.Equal(got, want) {
+			continue
+		}
+		differ++
+		if !utf8.Valid(got) || !utf8.Valid(want) {
+			fmt.Printf("%s: binary file differs\n", path)
+			continue
+		}
+		fmt.Printf("%s: differs\n", path)
+		fmt.Print(textdiff.Unified(path, path+" (generated)",
+			strings.Split(string(got), "\n"), strings.Split(string(want), "\n")))
+	}
+	return differ
 }
 
 func main() {
-	if len(os.Args) > 1 {
-		siteDir = os.Args[1]
-	}
-	ensureDir(siteDir)
-
-	copyFile("templates/site.css", siteDir+"/site.css")
-	copyFile("templates/site.js", siteDir+"/site.js")
-	copyFile("templates/favicon.ico", siteDir+"/favicon.ico")
-	copyFile("templates/404.html", siteDir+"/404.html")
-	copyFile("templates/play.png", siteDir+"/play.png")
-	copyFile("templates/clipboard.png", siteDir+"/clipboard.png")
-	examples := parseExamples()
-	renderIndex(examples)
-	renderExamples(examples)
+	validate := flag.Bool("validate", false, "only check examples.txt against the examples/ directory tree, without generating anything")
+	force := flag.Bool("force", false, "regenerate every page, ignoring the manifest of the previous build")
+	flag.IntVar(&jobs, "j", jobs, "number of example pages rendered in parallel")
+	watchMode := flag.Bool("watch", false, "keep running and regenerate the affected pages whenever examples/, templates/ or examples.txt change")
+	checkOnly := flag.Bool("check", false, "generate in memory and report files that differ from the site directory, without writing anything")
+	localeList := flag.String("locales", "", "comma-separated locales to build into per-locale subdirectories, e.g. en,zh; the first one is the default")
+	namingFlag := flag.String("naming", string(naming), "output file naming of example pages: bare (json), html (json.html) or dir (json/index.html)")
+	flag.StringVar(&chromaStyle, "style", chromaStyle, "chroma style appended to site.css (empty: use the rules in templates/site.css)")
+	flag.StringVar(&shareURL, "share-url", shareURL, "Go Playground share endpoint used by -refresh-hashes")
+	flag.BoolVar(&refreshHashes, "refresh-hashes", refreshHashes, "re-share examples whose source changed and rewrite their .hash files")
+	flag.BoolVar(&warnStaleHashes, "warn-stale-hashes", warnStaleHashes, "only warn about stale .hash files instead of failing")
+	flag.Parse()
+	if jobs < 1 {
+		fmt.Fprintf(os.Stderr, "-j must be at least 1, got %d\n", jobs)
+		os.Exit(2)
+	}
+	if chromaStyle != "" {
+		if _, ok := styles.Registry[chromaStyle]; !ok {
+			fmt.Fprintf(os.Stderr, "unknown chroma style %q; available: %s\n", chromaStyle, strings.Join(styles.Names(), ", "))
+			os.Exit(2)
+		}
+	}
+	var err error
+	locales, err = parseLocales(*localeList)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	naming, err = parseNaming(*namingFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if flag.NArg() > 0 {
+		siteDir = flag.Arg(0)
+	}
+
+	if *checkOnly {
+		if *watchMode {
+			fmt.Fprintln(os.Stderr, "-check and -watch can't be combined")
+			os.Exit(2)
+		}
+		if refreshHashes {
+			fmt.Fprintln(os.Stderr, "-check and -refresh-hashes can't be combined")
+			os.Exit(2)
+		}
+		siteOutput = newMemOutput()
+	}
+
+	var errs BuildErrors
+	if *validate {
+		validateExamples(&errs)
+		reportErrors(errs, "examples.txt and examples/ are out of sync")
+		return
+	}
+	// -check 必须完整地渲染所有页面才能比较
+	manifest := loadManifest(siteDir, *force || *checkOnly)
+	if *watchMode {
+		watch(manifest)
+		return
+	}
+	_, errs = generateSite(manifest, !*checkOnly)
+	reportErrors(errs, "the site was not fully generated")
+
+	if generated, ok := siteOutput.(*memOutput); ok {
+		if differ := checkSite(siteDir, generated.files); differ > 0 {
+			fmt.Fprintf(os.Stderr, "%d file(s) in %s are out of date; run tools/build and commit the result\n", differ, siteDir)
+			os.Exit(1)
+		}
+		if verbose() {
+			fmt.Printf("%s is up to date\n", siteDir)
+		}
+	}
 }
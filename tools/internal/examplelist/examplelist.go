@@ -0,0 +1,60 @@
+// Package examplelist knows how the examples are listed in examples.txt and how
+// their IDs, the names of their directories and pages, are derived.
+package examplelist
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ListPath is the list of examples, in the order the site shows them. Each
+// line is an example's English name, optionally followed by "|" and its
+// translated name; blank lines and lines starting with # are skipped.
+const ListPath = "examples.txt"
+
+// Entry is an example listed in examples.txt.
+type Entry struct {
+	Name string // the whole line, including any translated name
+	Line int    // line number in examples.txt, for reporting errors
+}
+
+// Entries reads the examples listed in examples.txt.
+func Entries() ([]Entry, error) {
+	data, err := os.ReadFile(ListPath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for i, line := range strings.Split(string(data), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, Entry{Name: line, Line: i + 1})
+		}
+	}
+	return entries, nil
+}
+
+// IDs returns the IDs of the examples listed in examples.txt, in order.
+func IDs() ([]string, error) {
+	entries, err := Entries()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, ID(strings.Split(entry.Name, "|")[0]))
+	}
+	return ids, nil
+}
+
+var dashPat = regexp.MustCompile(`-+`)
+
+// ID derives an example's ID from its English name, e.g. "Closures" gives
+// "closures" and "Time Formatting / Parsing" gives "time-formatting-parsing".
+func ID(name string) string {
+	id := strings.ToLower(name)
+	id = strings.Replace(id, " ", "-", -1)
+	id = strings.Replace(id, "/", "-", -1)
+	id = strings.Replace(id, "'", "", -1)
+	return dashPat.ReplaceAllString(id, "-")
+}
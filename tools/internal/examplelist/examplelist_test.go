@@ -0,0 +1,19 @@
+package examplelist
+
+import "testing"
+
+func TestID(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"Hello World", "hello-world"},
+		{"Time Formatting / Parsing", "time-formatting-parsing"},
+		{"Range over Built-in Types", "range-over-built-in-types"},
+		{"Go's Errors", "gos-errors"},
+	}
+	for _, tt := range tests {
+		if got := ID(tt.name); got != tt.want {
+			t.Errorf("ID(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
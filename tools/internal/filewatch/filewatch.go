@@ -0,0 +1,92 @@
+// Package filewatch polls files for changes, for the tools that rebuild or
+// reload the site while it's being edited.
+package filewatch
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// Interval is how often the files are polled.
+	Interval = 300 * time.Millisecond
+	// Quiet is how long the files have to stay the same after a change before
+	// it's reported, so that a burst of writes, like an editor saving or the
+	// generator writing the site, is reported once.
+	Quiet = 200 * time.Millisecond
+)
+
+// Snapshot records the size and modification time of files, by path.
+type Snapshot map[string]string
+
+// Take records every file under paths.
+func Take(paths ...string) Snapshot {
+	files := make(Snapshot)
+	for _, root := range paths {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				files[path] = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// Changed returns the files added, modified or removed between two snapshots,
+// sorted.
+func Changed(before, after Snapshot) []string {
+	var changed []string
+	for path, state := range after {
+		if before[path] != state {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Wait polls paths until they differ from last and have settled, and returns
+// the new snapshot along with the files that changed. It returns ctx's error
+// once ctx is done.
+func Wait(ctx context.Context, last Snapshot, paths ...string) (Snapshot, []string, error) {
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-ticker.C:
+		}
+		current := Take(paths...)
+		if len(Changed(last, current)) == 0 {
+			continue
+		}
+		for {
+			time.Sleep(Quiet)
+			settled := Take(paths...)
+			more := Changed(current, settled)
+			current = settled
+			if len(more) == 0 {
+				break
+			}
+		}
+		// Files that changed back, e.g. a temporary file an editor removed
+		// again, aren't a change.
+		if changed := Changed(last, current); len(changed) > 0 {
+			return current, changed, nil
+		}
+	}
+}
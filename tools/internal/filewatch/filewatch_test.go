@@ -0,0 +1,47 @@
+package filewatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChanged(t *testing.T) {
+	before := Snapshot{"a": "1 1", "b": "1 1", "c": "1 1"}
+	after := Snapshot{"a": "1 1", "b": "2 2", "d": "1 1"}
+	want := []string{"b", "c", "d"}
+	if got := Changed(before, after); !reflect.DeepEqual(got, want) {
+		t.Errorf("Changed = %v, want %v", got, want)
+	}
+}
+
+func TestWait(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "page")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	last := Take(dir)
+	go func() {
+		time.Sleep(Interval / 2)
+		os.WriteFile(path, []byte("new page"), 0644)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, changed, err := Wait(ctx, last, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{path}; !reflect.DeepEqual(changed, want) {
+		t.Errorf("Wait reported %v, want %v", changed, want)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*Interval)
+	defer cancel()
+	if _, _, err := Wait(ctx, Take(dir), dir); err != context.DeadlineExceeded {
+		t.Errorf("Wait without changes returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
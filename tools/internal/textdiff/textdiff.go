@@ -0,0 +1,105 @@
+// Package textdiff computes line diffs for the tools, e.g. to show how a
+// generated page or a command's output differs from what was expected.
+package textdiff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Op is one line of a diff: kept (' '), removed ('-') or added ('+'), with
+// the index it has in the old lines (A) and the new lines (B).
+type Op struct {
+	Kind byte
+	Line string
+	A, B int
+}
+
+// Lines computes the line operations that turn a into b, based on a
+// longest-common-subsequence table.
+func Lines(a, b []string) []Op {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var ops []Op
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, Op{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, Op{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, Op{'+', b[j], i, j})
+			j++
+		}
+	}
+	return ops
+}
+
+// Unified renders a line diff of a and b in unified format with three lines
+// of context. It's empty if a and b are the same.
+func Unified(aName, bName string, a, b []string) string {
+	ops := Lines(a, b)
+
+	const context = 3
+	var out strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change and the extent of its hunk.
+		for start < len(ops) && ops[start].Kind == ' ' {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].Kind != ' ' {
+				end = k
+			} else if k-end > 2*context {
+				break
+			}
+		}
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context + 1
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+		}
+		aCount, bCount := 0, 0
+		for _, o := range ops[from:to] {
+			if o.Kind != '+' {
+				aCount++
+			}
+			if o.Kind != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", ops[from].A+1, aCount, ops[from].B+1, bCount)
+		for _, o := range ops[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", o.Kind, o.Line)
+		}
+		start = to
+	}
+	return out.String()
+}
@@ -0,0 +1,29 @@
+package textdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"a\nb\nc", "a\nb\nc", ""},
+		{"a\nb\nc", "a\nx\nc", "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+x\n c\n"},
+		{"", "a", "--- old\n+++ new\n@@ -1,1 +1,1 @@\n-\n+a\n"},
+		// Changes more than six lines apart get hunks of their own.
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n10",
+			"x\n2\n3\n4\n5\n6\n7\n8\n9\ny",
+			"--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+y\n",
+		},
+	}
+	for _, tt := range tests {
+		got := Unified("old", "new", strings.Split(tt.a, "\n"), strings.Split(tt.b, "\n"))
+		if got != tt.want {
+			t.Errorf("Unified(%q, %q) =\n%s\nwant\n%s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,554 @@
+// Package transcript reads the .sh transcripts of the examples, normalizes
+// the output they record and updates it to what the commands print now.
+//
+// A transcript is a sequence of `$ command` lines, each followed by the output
+// it's expected to print. Lines starting with # are commentary and are
+// skipped, along with the blank lines around them. A recorded line of just
+// "..." stands for any number of lines, the way transcripts elide long output,
+// and a line of just ^C is where the command was interrupted.
+package transcript
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mmcgrana/gobyexample/tools/internal/textdiff"
+)
+
+// Step is one command of a transcript and the output recorded for it.
+type Step struct {
+	Line        int // line of the command in the transcript
+	Command     string
+	Output      []string
+	OutputLines []int // line of each line of Output in the transcript
+}
+
+// Parse splits a .sh transcript into its steps.
+func Parse(src string) []Step {
+	lines := strings.Split(strings.TrimRight(src, "\n"), "\n")
+	isComment := func(i int) bool {
+		return strings.HasPrefix(lines[i], "#")
+	}
+	isBlank := func(i int) bool {
+		return strings.TrimSpace(lines[i]) == ""
+	}
+	// Blank lines next to commentary only separate it from the output.
+	layout := make([]bool, len(lines))
+	for i := range lines {
+		if !isComment(i) {
+			continue
+		}
+		layout[i] = true
+		for j := i - 1; j >= 0 && isBlank(j); j-- {
+			layout[j] = true
+		}
+		for j := i + 1; j < len(lines) && isBlank(j); j++ {
+			layout[j] = true
+		}
+	}
+
+	var steps []Step
+	for i, line := range lines {
+		switch {
+		case layout[i]:
+		case strings.HasPrefix(line, "$ "):
+			steps = append(steps, Step{Line: i + 1, Command: strings.TrimSpace(line[2:])})
+		case len(steps) > 0:
+			last := &steps[len(steps)-1]
+			last.Output = append(last.Output, line)
+			last.OutputLines = append(last.OutputLines, i+1)
+		}
+	}
+	for i := range steps {
+		steps[i].Output = TrimOutput(steps[i].Output)
+		steps[i].OutputLines = steps[i].OutputLines[:len(steps[i].Output)]
+	}
+	return steps
+}
+
+// TrimOutput drops trailing whitespace, which terminals don't show, and the
+// blank lines at the end of an output.
+func TrimOutput(lines []string) []string {
+	var out []string
+	for _, line := range lines {
+		out = append(out, strings.TrimRight(line, " \t\r"))
+	}
+	for len(out) > 0 && out[len(out)-1] == "" {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// InterruptLine is how a terminal shows Ctrl-C; in a transcript it marks
+// where the command was interrupted.
+const InterruptLine = "^C"
+
+// Interrupt splits the output of a step at the ^C line, if it has one.
+func (s Step) Interrupt() (before, after []string, ok bool) {
+	for i, line := range s.Output {
+		if line == InterruptLine {
+			return s.Output[:i], s.Output[i+1:], true
+		}
+	}
+	return nil, nil, false
+}
+
+// Background reports whether the step starts its command in the background.
+func (s Step) Background() bool {
+	return strings.HasSuffix(s.Command, "&") && !strings.HasSuffix(s.Command, "&&")
+}
+
+// Rule is a normalization rule of a .verify file. replace substitutes
+// REPLACEMENT for every match of REGEXP, expanding $1 and the like to
+// submatches and \n and \t to a newline and a tab; with no "=> REPLACEMENT",
+// matches are removed. range replaces the submatches of REGEXP with
+// "<MIN..MAX>" where they're numbers within the range, so that a number out of
+// range shows up as a difference. unordered sorts each run of consecutive
+// lines matching REGEXP, for output printed by goroutines in no particular
+// order. Rules are applied in order to the output of every command of the
+// transcript, joined into one text. REGEXP is in multi-line mode, so ^ and $
+// match at line boundaries, and \s can match across lines.
+type Rule struct {
+	Line        int // line of the rule in the .verify file
+	Kind        string
+	Pattern     *regexp.Regexp
+	Replacement string
+	Min, Max    float64
+}
+
+// Normalize applies rules to the lines of an output.
+func Normalize(lines []string, rules []Rule) []string {
+	if len(rules) == 0 {
+		return lines
+	}
+	var out []string
+	for _, line := range normalizeTraced(lines, rules) {
+		out = append(out, line.text)
+	}
+	return out
+}
+
+// span is the range of lines of the original output that a byte of
+// normalized output comes from, or {-1, -1} for a line break a rule added.
+type span [2]int
+
+var noSpan = span{-1, -1}
+
+func (s span) widen(t span) span {
+	switch {
+	case s[0] < 0:
+		return t
+	case t[0] < 0:
+		return s
+	}
+	if t[0] < s[0] {
+		s[0] = t[0]
+	}
+	if t[1] > s[1] {
+		s[1] = t[1]
+	}
+	return s
+}
+
+// tracedLine is a line of normalized output with the span of each byte of
+// text, followed by that of the line break after it.
+type tracedLine struct {
+	text  string
+	spans []span
+}
+
+// normalizeTraced applies rules to the lines of an output like Normalize, but
+// keeps track of where each line of the result comes from (see sources).
+func normalizeTraced(lines []string, rules []Rule) []tracedLine {
+	var traced []tracedLine
+	for i, line := range lines {
+		spans := make([]span, len(line)+1)
+		for j := range spans {
+			spans[j] = span{i, i}
+		}
+		traced = append(traced, tracedLine{line, spans})
+	}
+	for _, rule := range rules {
+		switch rule.Kind {
+		case "replace":
+			text, spans := joinTraced(traced)
+			traced = splitTraced(replaceTraced(text, spans, rule.Pattern, rule.Replacement))
+		case "range":
+			text, spans := joinTraced(traced)
+			traced = splitTraced(replaceInRange(text, spans, rule))
+		case "unordered":
+			traced = sortRuns(traced, rule.Pattern)
+		}
+	}
+	// Like TrimOutput.
+	for i, line := range traced {
+		text := strings.TrimRight(line.text, " \t\r")
+		spans := append(line.spans[:len(text):len(text)], line.spans[len(line.text)])
+		traced[i] = tracedLine{text, spans}
+	}
+	for len(traced) > 0 && traced[len(traced)-1].text == "" {
+		traced = traced[:len(traced)-1]
+	}
+	return traced
+}
+
+// sources returns the lines of the original output of n lines that each line
+// of normalized comes from. An original line belongs to the first line that
+// some of its text ended up in, or for a blank line, its line break; lines the
+// rules removed belong to none.
+func sources(normalized []tracedLine, n int) [][]int {
+	owned := make([]bool, n)
+	out := make([][]int, len(normalized))
+	for i, line := range normalized {
+		spans := line.spans[:len(line.text)]
+		if line.text == "" {
+			spans = line.spans
+		}
+		for _, s := range spans {
+			for k := s[0]; k >= 0 && k <= s[1]; k++ {
+				if !owned[k] {
+					owned[k] = true
+					out[i] = append(out[i], k)
+				}
+			}
+		}
+		sort.Ints(out[i])
+	}
+	return out
+}
+
+func joinTraced(lines []tracedLine) (string, []span) {
+	var b strings.Builder
+	var spans []span
+	for i, line := range lines {
+		b.WriteString(line.text)
+		if i < len(lines)-1 {
+			b.WriteByte('\n')
+			spans = append(spans, line.spans...)
+		} else {
+			spans = append(spans, line.spans[:len(line.text)]...)
+		}
+	}
+	return b.String(), spans
+}
+
+func splitTraced(text string, spans []span) []tracedLine {
+	var lines []tracedLine
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			line := tracedLine{text, append(spans[:len(text):len(text)], noSpan)}
+			return append(lines, line)
+		}
+		lines = append(lines, tracedLine{text[:i], spans[: i+1 : i+1]})
+		text, spans = text[i+1:], spans[i+1:]
+	}
+}
+
+// replaceTraced does what pattern.ReplaceAllString(text, template) does. The
+// text of submatches keeps its spans; the rest of the replacement comes from
+// the whole match, except for line breaks, which come from nowhere, so that
+// lines a rule removes don't belong to the lines around them.
+func replaceTraced(text string, spans []span, pattern *regexp.Regexp, template string) (string, []span) {
+	var b strings.Builder
+	var out []span
+	last := 0
+	for _, m := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(text[last:m[0]])
+		out = append(out, spans[last:m[0]]...)
+		match := noSpan
+		for _, s := range spans[m[0]:m[1]] {
+			match = match.widen(s)
+		}
+		literal := func(s string) {
+			b.WriteString(s)
+			for _, c := range []byte(s) {
+				if c == '\n' {
+					out = append(out, noSpan)
+				} else {
+					out = append(out, match)
+				}
+			}
+		}
+		// The same template syntax as regexp.Regexp.Expand.
+		for t := template; len(t) > 0; {
+			i := strings.IndexByte(t, '$')
+			if i < 0 {
+				literal(t)
+				break
+			}
+			literal(t[:i])
+			t = t[i:]
+			if len(t) > 1 && t[1] == '$' {
+				literal("$")
+				t = t[2:]
+				continue
+			}
+			group, rest, ok := templateGroup(pattern, t)
+			if !ok {
+				literal("$")
+				t = t[1:]
+				continue
+			}
+			t = rest
+			if group >= 0 && 2*group+1 < len(m) && m[2*group] >= 0 {
+				b.WriteString(text[m[2*group]:m[2*group+1]])
+				out = append(out, spans[m[2*group]:m[2*group+1]]...)
+			}
+		}
+		last = m[1]
+	}
+	b.WriteString(text[last:])
+	out = append(out, spans[last:]...)
+	return b.String(), out
+}
+
+// templateGroup parses the $name or ${name} reference at the start of t,
+// returning the index of the submatch it refers to, or -1 if there's none.
+func templateGroup(pattern *regexp.Regexp, t string) (group int, rest string, ok bool) {
+	t = t[1:]
+	brace := strings.HasPrefix(t, "{")
+	if brace {
+		t = t[1:]
+	}
+	i := 0
+	for i < len(t) && isNameByte(t[i]) {
+		i++
+	}
+	if i == 0 {
+		return 0, "", false
+	}
+	name := t[:i]
+	if brace {
+		if i >= len(t) || t[i] != '}' {
+			return 0, "", false
+		}
+		i++
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, t[i:], true
+	}
+	for n, subexp := range pattern.SubexpNames() {
+		if subexp == name {
+			return n, t[i:], true
+		}
+	}
+	return -1, t[i:], true
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// replaceInRange replaces the numbers that rule matches with its placeholder
+// where they're within range.
+func replaceInRange(text string, spans []span, rule Rule) (string, []span) {
+	placeholder := fmt.Sprintf("<%v..%v>", rule.Min, rule.Max)
+	var b strings.Builder
+	var out []span
+	last := 0
+	for _, m := range rule.Pattern.FindAllStringSubmatchIndex(text, -1) {
+		for g := 2; g < len(m); g += 2 {
+			if m[g] < 0 {
+				continue
+			}
+			n, err := strconv.ParseFloat(text[m[g]:m[g+1]], 64)
+			if err != nil || n < rule.Min || n > rule.Max {
+				continue
+			}
+			b.WriteString(text[last:m[g]])
+			out = append(out, spans[last:m[g]]...)
+			number := noSpan
+			for _, s := range spans[m[g]:m[g+1]] {
+				number = number.widen(s)
+			}
+			b.WriteString(placeholder)
+			for k := 0; k < len(placeholder); k++ {
+				out = append(out, number)
+			}
+			last = m[g+1]
+		}
+	}
+	b.WriteString(text[last:])
+	out = append(out, spans[last:]...)
+	return b.String(), out
+}
+
+// sortRuns sorts each run of consecutive lines that match pattern.
+func sortRuns(lines []tracedLine, pattern *regexp.Regexp) []tracedLine {
+	for i := 0; i < len(lines); {
+		if !pattern.MatchString(lines[i].text) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lines) && pattern.MatchString(lines[j].text) {
+			j++
+		}
+		run := lines[i:j]
+		sort.SliceStable(run, func(a, b int) bool { return run[a].text < run[b].text })
+		i = j
+	}
+	return lines
+}
+
+// Match reports whether got matches the recorded lines want, in which
+// a "..." line matches any number of lines.
+func Match(want, got []string) bool {
+	if len(want) == 0 {
+		return len(got) == 0
+	}
+	if want[0] == "..." {
+		for skip := 0; skip <= len(got); skip++ {
+			if Match(want[1:], got[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return len(got) > 0 && want[0] == got[0] && Match(want[1:], got[1:])
+}
+
+// OutputLine is a line of updated output, with the index of the recorded line
+// it keeps or takes the place of, or -1 for an additional line.
+type OutputLine struct {
+	Text     string
+	Recorded int
+}
+
+// Update returns the output to record for a command in place of
+// recorded, now that it prints actual. Both outputs are normalized as a whole,
+// as when they're compared, and the normalized lines are diffed. Recorded
+// lines that still match are kept as they are, so that the placeholders and
+// edits of the transcript's author survive, and a stretch of changes that a
+// "..." line of the recording covered is covered by it again. The lines of
+// actual that are added are those the new normalized lines come from, so lines
+// that the rules remove, like the user and sys lines of `time`, aren't added.
+func Update(recorded, actual []string, rules []Rule) []OutputLine {
+	a, b := normalizeTraced(recorded, rules), normalizeTraced(actual, rules)
+	aSources, bSources := sources(a, len(recorded)), sources(b, len(actual))
+	var aText, bText []string
+	for _, line := range a {
+		aText = append(aText, line.text)
+	}
+	for _, line := range b {
+		bText = append(bText, line.text)
+	}
+	ops := textdiff.Lines(aText, bText)
+
+	var out []OutputLine
+	for start := 0; start < len(ops); {
+		if op := ops[start]; op.Kind == ' ' {
+			for _, k := range aSources[op.A] {
+				out = append(out, OutputLine{recorded[k], k})
+			}
+			if len(aSources[op.A]) == 0 {
+				// A line a rule added, like a blank line before `real`.
+				out = append(out, OutputLine{op.Line, -1})
+			}
+			start++
+			continue
+		}
+		end := start
+		elided, elidedAt := false, -1
+		var removed []int
+		for ; end < len(ops) && ops[end].Kind != ' '; end++ {
+			if op := ops[end]; op.Kind == '-' {
+				removed = append(removed, aSources[op.A]...)
+				if op.Line == "..." && !elided {
+					elided = true
+					if len(aSources[op.A]) > 0 {
+						elidedAt = aSources[op.A][0]
+					}
+				}
+			}
+		}
+		if elided {
+			out = append(out, OutputLine{"...", elidedAt})
+		} else {
+			// New lines take the place of the removed ones, in order.
+			add := func(text string) {
+				at := -1
+				if len(removed) > 0 {
+					at, removed = removed[0], removed[1:]
+				}
+				out = append(out, OutputLine{text, at})
+			}
+			for _, op := range ops[start:end] {
+				if op.Kind != '+' {
+					continue
+				}
+				for _, k := range bSources[op.B] {
+					add(actual[k])
+				}
+				if len(bSources[op.B]) == 0 {
+					add(op.Line)
+				}
+			}
+		}
+		start = end
+	}
+	return out
+}
+
+// Rewrite replaces the recorded output of steps of a transcript,
+// leaving the commands alone. Commentary within an output is about the lines
+// after it, so it stays before the recorded line it preceded, or before the
+// next line kept if that one is gone.
+func Rewrite(src string, steps []Step, outputs map[int][]OutputLine) string {
+	lines := strings.Split(src, "\n")
+	// Rewrite from the end, so that line numbers before stay valid.
+	for i := len(steps) - 1; i >= 0; i-- {
+		output, ok := outputs[i]
+		if !ok {
+			continue
+		}
+		step := steps[i]
+		at := step.OutputLines
+		from, to := step.Line, step.Line // 0-based [from, to) to replace
+		if len(at) > 0 {
+			from, to = at[0]-1, at[len(at)-1]
+		}
+		// The commentary after each recorded line but the last.
+		var layout [][]string
+		for k := 0; k+1 < len(at); k++ {
+			layout = append(layout, lines[at[k]:at[k+1]-1])
+		}
+
+		var region []string
+		flushed := 0
+		flush := func(through int) {
+			for ; flushed <= through && flushed < len(layout); flushed++ {
+				block := layout[flushed]
+				if len(block) > 0 && len(region) > 0 && block[0] == "" && region[len(region)-1] == "" {
+					block = block[1:]
+				}
+				region = append(region, block...)
+			}
+		}
+		for _, line := range output {
+			// A blank line right after commentary would be read as part of
+			// it, so it can't be recorded there.
+			if line.Text == "" && len(region) > 0 && strings.HasPrefix(region[len(region)-1], "#") {
+				continue
+			}
+			text := line.Text
+			if line.Recorded >= 0 {
+				flush(line.Recorded - 1)
+				// A line kept as it is keeps the whitespace that Parse
+				// trimmed, too.
+				if raw := lines[at[line.Recorded]-1]; strings.TrimRight(raw, " \t\r") == text {
+					text = raw
+				}
+			}
+			region = append(region, text)
+		}
+		flush(len(layout))
+		rest := append(region, lines[to:]...)
+		lines = append(lines[:from], rest...)
+	}
+	return strings.Join(lines, "\n")
+}
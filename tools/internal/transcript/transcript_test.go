@@ -0,0 +1,227 @@
+package transcript
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func replace(pattern, replacement string) Rule {
+	return Rule{Kind: "replace", Pattern: regexp.MustCompile("(?m)" + pattern), Replacement: replacement}
+}
+
+func TestParse(t *testing.T) {
+	src := "# Run it.\n\n$ go run x.go  \na  \n\n# More.\n\nb\n\n\n$ echo $?\n0\n"
+	want := []Step{
+		{Line: 3, Command: "go run x.go", Output: []string{"a", "b"}, OutputLines: []int{4, 8}},
+		{Line: 11, Command: "echo $?", Output: []string{"0"}, OutputLines: []int{12}},
+	}
+	if got := Parse(src); !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse(%q) =\n%+v\nwant\n%+v", src, got, want)
+	}
+}
+
+func TestNormalizeSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		rules   []Rule
+		want    []string
+		sources [][]int
+	}{
+		{
+			name:    "no rules",
+			lines:   []string{"a", "", "b"},
+			want:    []string{"a", "", "b"},
+			sources: [][]int{{0}, {1}, {2}},
+		},
+		{
+			// Like the rules for `time`, which drop its user and sys lines.
+			name:    "removed lines",
+			lines:   []string{"done", "", "real\t0m1.002s", "user\t0m0.001s", "sys\t0m0.002s"},
+			rules:   []Rule{replace(`^real\t\S+$`, "real <elapsed>"), replace(`^(user|sys)\t.*\n?`, "")},
+			want:    []string{"done", "", "real <elapsed>"},
+			sources: [][]int{{0}, {1}, {2}},
+		},
+		{
+			name:    "joined lines",
+			lines:   []string{"x", "y", "z"},
+			rules:   []Rule{replace(`^x\ny$`, "xy")},
+			want:    []string{"xy", "z"},
+			sources: [][]int{{0, 1}, {2}},
+		},
+		{
+			// A line break the rule adds comes from nowhere, so the second
+			// line has nothing of its own.
+			name:    "split line",
+			lines:   []string{"a b", "c"},
+			rules:   []Rule{replace(`^(\w) (\w)$`, "$1\n$2")},
+			want:    []string{"a", "b", "c"},
+			sources: [][]int{{0}, nil, {1}},
+		},
+		{
+			name:    "elided lines",
+			lines:   []string{"PATH=/bin", "HOME=/root", "USER=me", "end"},
+			rules:   []Rule{replace(`^(\w+=.*\n)+`, "...\n")},
+			want:    []string{"...", "end"},
+			sources: [][]int{{0, 1, 2}, {3}},
+		},
+		{
+			name:    "range",
+			lines:   []string{"took 5ms", "took 50ms"},
+			rules:   []Rule{{Kind: "range", Pattern: regexp.MustCompile(`(?m)^took (\d+)ms$`), Min: 1, Max: 10}},
+			want:    []string{"took <1..10>ms", "took 50ms"},
+			sources: [][]int{{0}, {1}},
+		},
+		{
+			name:    "unordered",
+			lines:   []string{"worker 2", "worker 1", "done"},
+			rules:   []Rule{{Kind: "unordered", Pattern: regexp.MustCompile(`(?m)^worker`)}},
+			want:    []string{"worker 1", "worker 2", "done"},
+			sources: [][]int{{1}, {0}, {2}},
+		},
+	}
+	for _, tt := range tests {
+		normalized := normalizeTraced(tt.lines, tt.rules)
+		var got []string
+		for _, line := range normalized {
+			got = append(got, line.text)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: normalized to %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		if got := sources(normalized, len(tt.lines)); !reflect.DeepEqual(got, tt.sources) {
+			t.Errorf("%s: sources = %v, want %v", tt.name, got, tt.sources)
+		}
+		if got := Normalize(tt.lines, tt.rules); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Normalize = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name             string
+		recorded, actual []string
+		rules            []Rule
+		want             []OutputLine
+	}{
+		{
+			name:     "changed line",
+			recorded: []string{"a", "b", "c"},
+			actual:   []string{"a", "x", "c"},
+			want:     []OutputLine{{"a", 0}, {"x", 1}, {"c", 2}},
+		},
+		{
+			name:     "added and removed lines",
+			recorded: []string{"a", "b", "c"},
+			actual:   []string{"x", "y", "a", "c"},
+			want:     []OutputLine{{"x", -1}, {"y", -1}, {"a", 0}, {"c", 2}},
+		},
+		{
+			// The recorded line keeps its value where the rule hides the
+			// difference.
+			name:     "normalized line",
+			recorded: []string{"took 3ms", "b"},
+			actual:   []string{"took 7ms", "x"},
+			rules:    []Rule{{Kind: "range", Pattern: regexp.MustCompile(`(?m)^took (\d+)ms$`), Min: 1, Max: 10}},
+			want:     []OutputLine{{"took 3ms", 0}, {"x", 1}},
+		},
+		{
+			// Lines the rules drop aren't added back.
+			name:     "removed lines",
+			recorded: []string{"a", "user 1"},
+			actual:   []string{"b", "user 2"},
+			rules:    []Rule{replace(`^user .*\n?`, "")},
+			want:     []OutputLine{{"b", 0}},
+		},
+		{
+			name:     "elided lines",
+			recorded: []string{"start", "...", "end"},
+			actual:   []string{"start", "1", "2", "stop"},
+			want:     []OutputLine{{"start", 0}, {"...", 1}},
+		},
+	}
+	for _, tt := range tests {
+		if got := Update(tt.recorded, tt.actual, tt.rules); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Update = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	src := "# Run it.\n\n$ go run x.go\na\n\n# About b.\n\nb\nc\n\n$ echo done\ndone\n"
+	tests := []struct {
+		name   string
+		output []OutputLine
+		want   string
+	}{
+		{
+			name:   "changed line",
+			output: []OutputLine{{"a", 0}, {"x", 1}, {"c", 2}},
+			want:   "# Run it.\n\n$ go run x.go\na\n\n# About b.\n\nx\nc\n\n$ echo done\ndone\n",
+		},
+		{
+			// Commentary stays before the line it preceded, even when lines
+			// are added before that.
+			name:   "added line",
+			output: []OutputLine{{"a", 0}, {"y", -1}, {"b", 1}, {"c", 2}},
+			want:   "# Run it.\n\n$ go run x.go\na\ny\n\n# About b.\n\nb\nc\n\n$ echo done\ndone\n",
+		},
+		{
+			// Or before the next line kept, if that one is gone.
+			name:   "removed line",
+			output: []OutputLine{{"a", 0}, {"c", 2}},
+			want:   "# Run it.\n\n$ go run x.go\na\n\n# About b.\n\nc\n\n$ echo done\ndone\n",
+		},
+		{
+			// A blank line can't follow commentary.
+			name:   "blank line",
+			output: []OutputLine{{"a", 0}, {"", -1}, {"b", 1}},
+			want:   "# Run it.\n\n$ go run x.go\na\n\n# About b.\n\nb\n\n$ echo done\ndone\n",
+		},
+	}
+	steps := Parse(src)
+	for _, tt := range tests {
+		got := Rewrite(src, steps, map[int][]OutputLine{0: tt.output})
+		if got != tt.want {
+			t.Errorf("%s: Rewrite =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestRewriteUnchanged checks that recording the output a transcript already
+// shows leaves it byte for byte as it is, for every transcript of the examples.
+func TestRewriteUnchanged(t *testing.T) {
+	srcs := map[string]string{
+		"trailing whitespace": "$ go run x.go \na  \n\n# About b.\n\nb\t\n\n",
+		"no output":           "$ go run x.go\n$ echo $?\n0",
+	}
+	paths, err := filepath.Glob("../../../examples/*/*.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no transcripts found")
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcs[path] = string(data)
+	}
+	for name, src := range srcs {
+		steps := Parse(src)
+		outputs := make(map[int][]OutputLine)
+		for i, step := range steps {
+			outputs[i] = Update(step.Output, step.Output, nil)
+		}
+		if got := Rewrite(src, steps, outputs); got != src {
+			t.Errorf("%s: Rewrite changed the transcript to\n%s", name, got)
+		}
+	}
+}
@@ -6,42 +6,91 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"unicode/utf8"
 )
 
-func check(err error) {
+func readLines(path string) ([]string, error) {
+	srcBytes, err := os.ReadFile(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	return strings.Split(string(srcBytes), "\n"), nil
 }
 
-func readLines(path string) []string {
-	srcBytes, err := os.ReadFile(path)
-	check(err)
-	return strings.Split(string(srcBytes), "\n")
+var commentPat = regexp.MustCompile("\\s*\\/\\/")
+
+// translationPat matches the files translated into some locale, which have
+// the locale after the extension of the English file.
+var translationPat = regexp.MustCompile(`\.(go|sh)\.[a-z]{2}(-[a-zA-Z]+)?$`)
+
+func measured(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".go" || ext == ".sh" || translationPat.MatchString(path)
 }
 
-var commentPat = regexp.MustCompile("\\s*\\/\\/")
+// width returns how many columns line takes up in a monospace font, where
+// the wide characters of East Asian scripts, which translations use, take up
+// two.
+func width(line string) int {
+	n := 0
+	for _, r := range line {
+		n++
+		if isWide(r) {
+			n++
+		}
+	}
+	return n
+}
+
+func isWide(r rune) bool {
+	switch {
+	case r >= 0x1100 && r <= 0x115F, // Hangul Jamo
+		r >= 0x2E80 && r <= 0xA4CF && r != 0x303F, // CJK radicals to Yi
+		r >= 0xAC00 && r <= 0xD7A3,                // Hangul syllables
+		r >= 0xF900 && r <= 0xFAFF,                // CJK compatibility ideographs
+		r >= 0xFE30 && r <= 0xFE4F,                // CJK compatibility forms
+		r >= 0xFF00 && r <= 0xFF60,                // fullwidth forms
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x20000 && r <= 0x3FFFD:
+		return true
+	}
+	return false
+}
 
 func main() {
 	sourcePaths, err := filepath.Glob("./examples/*/*")
-	check(err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "measure: %v\n", err)
+		os.Exit(1)
+	}
 	foundLongFile := false
+	foundError := false
 	for _, sourcePath := range sourcePaths {
+		// Only the code and the shell sessions end up on the site, translated
+		// (like hello-world.go.zh) or not; .hash and .verify files are free
+		// to be as long as they need.
+		if !measured(sourcePath) {
+			continue
+		}
 		foundLongLine := false
-		lines := readLines(sourcePath)
+		lines, err := readLines(sourcePath)
+		if err != nil {
+			// Keep going so that every problem is reported in one run.
+			fmt.Fprintf(os.Stderr, "measure: %v\n", err)
+			foundError = true
+			continue
+		}
 		for i, line := range lines {
 			// Convert tabs to spaces before measuring, so we get an accurate measure
 			// of how long the output will end up being.
 			line := strings.Replace(line, "\t", "    ", -1)
-			if !foundLongLine && !commentPat.MatchString(line) && (utf8.RuneCountInString(line) > 58) {
+			if !foundLongLine && !commentPat.MatchString(line) && (width(line) > 58) {
 				fmt.Printf("measure: %s:%d\n", sourcePath, i+1)
 				foundLongLine = true
 				foundLongFile = true
 			}
 		}
 	}
-	if foundLongFile {
+	if foundLongFile || foundError {
 		os.Exit(1)
 	}
 }
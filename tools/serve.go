@@ -1,13 +1,336 @@
+// Serves the generated site from the public/ directory for local development,
+// with the same semantics as production: pages are found whether they're
+// requested as /json, /json.html or /json/, whichever -naming the site was
+// generated with, extension-less files are served as HTML, and unknown paths
+// get 404.html with a 404 status.
+//
+// Served HTML pages get a small script that listens for Server-Sent Events and
+// reloads the page whenever the contents of public/ change. With -rebuild, the
+// server also runs the generator in watch mode, so editing an example refreshes
+// the open pages automatically.
 package main
 
 import (
+	"bytes"
+	"context"
+	"flag"
 	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mmcgrana/gobyexample/tools/internal/filewatch"
 )
 
+// reloadPath is the Server-Sent Events endpoint the injected script listens on.
+const reloadPath = "/_reload"
+
+// reloadScript is injected before </body> of every served HTML page.
+const reloadScript = `<script>
+  new EventSource("` + reloadPath + `").addEventListener("reload", function() {
+    location.reload();
+  });
+</script>
+`
+
+// broker fans out reload notifications to the connected browsers.
+type broker struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]bool
+}
+
+func newBroker() *broker {
+	return &broker{clients: make(map[chan struct{}]bool)}
+}
+
+func (b *broker) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.clients[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broker) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+func (b *broker) publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		// A client that hasn't consumed the previous notification will reload
+		// anyway, so there's no need to queue another one.
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams a "reload" event to the client every time the site changes.
+func (b *broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-ch:
+			fmt.Fprint(w, "event: reload\ndata: \n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// site serves the files of a generated site directory.
+type site struct {
+	dir string
+}
+
+// resolve maps a cleaned request path to the file that serves it and the
+// canonical URL of that file. Both are empty if no file matches.
+func (s site) resolve(urlPath string) (file, canonical string) {
+	name := strings.Trim(urlPath, "/")
+	var candidates []string
+	if name == "" {
+		candidates = []string{"index.html"}
+	} else {
+		base := strings.TrimSuffix(name, ".html")
+		candidates = []string{base, base + ".html", base + "/index.html"}
+	}
+	for _, c := range candidates {
+		info, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(c)))
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if c == "index.html" || strings.HasSuffix(c, "/index.html") {
+			return c, "/" + strings.TrimSuffix(c, "index.html")
+		}
+		return c, "/" + c
+	}
+	return "", ""
+}
+
+// contentType mirrors the content types the site is uploaded with: pages
+// without an extension are HTML.
+func contentType(file string) string {
+	ext := path.Ext(file)
+	if ext == "" {
+		return "text/html; charset=utf-8"
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+func (s site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && urlPath != "/" {
+		urlPath += "/"
+	}
+	file, canonical := s.resolve(urlPath)
+	if file == "" {
+		s.serveFile(w, r, "404.html", http.StatusNotFound)
+		return
+	}
+	// Redirect the other spellings of a page to the one that exists, so that
+	// the relative links within it resolve as they do in production.
+	if canonical != r.URL.Path {
+		target := canonical
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	s.serveFile(w, r, file, http.StatusOK)
+}
+
+func (s site) serveFile(w http.ResponseWriter, r *http.Request, file string, status int) {
+	f, err := os.Open(filepath.Join(s.dir, filepath.FromSlash(file)))
+	if err != nil {
+		if status == http.StatusNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType(file))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, f)
+		}
+		return
+	}
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
+
+// bufferedResponse captures a response so that HTML can be rewritten before it
+// is sent to the client.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) WriteHeader(status int)      { b.status = status }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+// injectReload serves files from next, adding reloadScript to HTML responses.
+func injectReload(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The page is rewritten on the way out, so conditional and partial
+		// requests against the file on disk don't apply.
+		r.Header.Del("If-Modified-Since")
+		r.Header.Del("If-None-Match")
+		r.Header.Del("Range")
+
+		// A HEAD request is answered with the headers of the page as a GET
+		// gets it, script included, and no body.
+		head := r.Method == http.MethodHead
+		if head {
+			r = r.Clone(r.Context())
+			r.Method = http.MethodGet
+		}
+
+		resp := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(resp, r)
+
+		body := resp.body.Bytes()
+		if strings.HasPrefix(resp.header.Get("Content-Type"), "text/html") {
+			if i := bytes.LastIndex(body, []byte("</body>")); i >= 0 {
+				body = append(body[:i:i], append([]byte(reloadScript), body[i:]...)...)
+			} else {
+				body = append(body, reloadScript...)
+			}
+			resp.header.Set("Cache-Control", "no-store")
+		}
+		for k, v := range resp.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(resp.status)
+		if !head {
+			w.Write(body)
+		}
+	})
+}
+
+// watchDir notifies b whenever the files of dir change. A rebuild writing
+// many files settles before it's noticed, so that it results in one reload.
+func watchDir(dir string, b *broker) {
+	last := filewatch.Take(dir)
+	for {
+		current, _, err := filewatch.Wait(context.Background(), last, dir)
+		if err != nil {
+			return
+		}
+		last = current
+		log.Printf("%s changed; reloading pages", dir)
+		b.publish()
+	}
+}
+
+// startRebuild runs the generator in watch mode so that edits to the examples
+// and templates are regenerated into dir, which in turn triggers a reload. It
+// returns a function that stops the generator. go run starts the generator
+// as a process of its own, so both run in a process group that's stopped as a
+// whole.
+func startRebuild(dir string) (stop func()) {
+	cmd := exec.Command("go", "run", "tools/generate.go", "-watch", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("generator stopped: %v", err)
+		}
+	}()
+	return func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+}
+
 func main() {
-	port := "8000"
-	publicDir := "public"
-	fmt.Printf("Serving Go by Example at http://127.0.0.1:%s\n", port)
-	http.ListenAndServe(":"+port, http.FileServer(http.Dir(publicDir)))
+	addr := flag.String("addr", "", "address to listen on, as host:port, or just a host to listen on -port of (all interfaces if empty)")
+	port := flag.String("port", "8000", "port to listen on when -addr has none")
+	publicDir := flag.String("dir", "public", "directory of the generated site")
+	rebuild := flag.Bool("rebuild", false, "also run tools/generate -watch to regenerate the site when examples change")
+	flag.Parse()
+
+	b := newBroker()
+	go watchDir(*publicDir, b)
+
+	stopRebuild := func() {}
+	if *rebuild {
+		stopRebuild = startRebuild(*publicDir)
+		// Ctrl-C doesn't reach the generator's process group, so stop it here.
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-interrupt
+			stopRebuild()
+			os.Exit(1)
+		}()
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(reloadPath, b)
+	mux.Handle("/", injectReload(site{dir: *publicDir}))
+
+	listen := *addr
+	host, listenPort, err := net.SplitHostPort(listen)
+	if err != nil {
+		host, listenPort = listen, *port
+		listen = net.JoinHostPort(host, listenPort)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	fmt.Printf("Serving Go by Example at http://%s/\n", net.JoinHostPort(host, listenPort))
+	err = http.ListenAndServe(listen, mux)
+	stopRebuild()
+	log.Fatal(err)
 }
@@ -0,0 +1,288 @@
+// Reports which translated example sources are missing or out of date with
+// respect to the English sources they were translated from.
+//
+// Translations live next to the English files with the locale appended
+// (examples/json/json.go.zh). The English version each translation was last
+// synced against is recorded in translations/<locale>.txt as the git blob hash
+// of the English file, so the English text of that version can be recovered
+// from git to show what changed since.
+//
+// Usage:
+//
+//	tools/translations [-locale zh] [-json]      # status of every translation
+//	tools/translations -diff [example-id...]     # English comment changes since the last sync
+//	tools/translations -sync example-id...       # record the current English sources as translated
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mmcgrana/gobyexample/tools/internal/examplelist"
+	"github.com/mmcgrana/gobyexample/tools/internal/textdiff"
+)
+
+var docsPat = regexp.MustCompile(`^\s*(\/\/|#)\s`)
+
+const (
+	statusMissing  = "missing"
+	statusUpToDate = "up to date"
+	statusStale    = "stale"
+)
+
+// Translation is the state of one translated source file.
+type Translation struct {
+	Example     string `json:"example"`
+	Source      string `json:"source"`
+	Translation string `json:"translation"`
+	Status      string `json:"status"`
+	SyncedHash  string `json:"synced_hash,omitempty"`
+	CurrentHash string `json:"current_hash"`
+}
+
+// blobHash computes the git blob hash of the file contents, i.e. what
+// `git hash-object` prints for it.
+func blobHash(data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func manifestPath(locale string) string {
+	return filepath.Join("translations", locale+".txt")
+}
+
+// readManifest reads the source path -> blob hash records for a locale. A
+// missing manifest simply means nothing has been synced yet.
+func readManifest(locale string) (map[string]string, error) {
+	synced := make(map[string]string)
+	data, err := os.ReadFile(manifestPath(locale))
+	if os.IsNotExist(err) {
+		return synced, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && !strings.HasPrefix(line, "#") {
+			synced[fields[0]] = fields[1]
+		}
+	}
+	return synced, nil
+}
+
+func writeManifest(locale string, synced map[string]string) error {
+	var paths []string
+	for path := range synced {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	b.WriteString("# English source path and the git blob hash it was translated from.\n")
+	b.WriteString("# Maintained by tools/translations -sync.\n")
+	for _, path := range paths {
+		fmt.Fprintf(&b, "%s %s\n", path, synced[path])
+	}
+	if err := os.MkdirAll(filepath.Dir(manifestPath(locale)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath(locale), []byte(b.String()), 0644)
+}
+
+// englishSources returns the English .go and .sh files of an example.
+func englishSources(id string) ([]string, error) {
+	var sources []string
+	for _, ext := range []string{"*.go", "*.sh"} {
+		paths, err := filepath.Glob(filepath.Join("examples", id, ext))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, paths...)
+	}
+	sort.Strings(sources)
+	return sources, nil
+}
+
+func translationStatus(ids []string, locale string, synced map[string]string) ([]Translation, error) {
+	var result []Translation
+	for _, id := range ids {
+		sources, err := englishSources(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range sources {
+			data, err := os.ReadFile(source)
+			if err != nil {
+				return nil, err
+			}
+			t := Translation{
+				Example:     id,
+				Source:      filepath.ToSlash(source),
+				Translation: filepath.ToSlash(source + "." + locale),
+				SyncedHash:  synced[filepath.ToSlash(source)],
+				CurrentHash: blobHash(data),
+			}
+			switch {
+			case !fileExists(t.Translation):
+				t.Status = statusMissing
+			case t.SyncedHash == t.CurrentHash:
+				t.Status = statusUpToDate
+			default:
+				t.Status = statusStale
+			}
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// commentLines extracts the prose of a source file, which is what gets
+// translated; code changes alone don't need a new translation.
+func commentLines(src string) []string {
+	var lines []string
+	for _, line := range strings.Split(src, "\n") {
+		if docsPat.MatchString(line) {
+			lines = append(lines, docsPat.ReplaceAllString(line, ""))
+		}
+	}
+	return lines
+}
+
+// gitBlob returns the contents of a blob from the git object database.
+func gitBlob(hash string) (string, error) {
+	out, err := exec.Command("git", "cat-file", "-p", hash).Output()
+	if err != nil {
+		return "", fmt.Errorf("git cat-file %s: %v", hash, err)
+	}
+	return string(out), nil
+}
+
+func printTable(translations []Translation) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "EXAMPLE\tSOURCE\tSTATUS")
+	counts := make(map[string]int)
+	for _, t := range translations {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", t.Example, filepath.Base(t.Source), t.Status)
+		counts[t.Status]++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d up to date, %d stale, %d missing\n",
+		counts[statusUpToDate], counts[statusStale], counts[statusMissing])
+	return nil
+}
+
+func printDiffs(translations []Translation) error {
+	for _, t := range translations {
+		if t.Status != statusStale {
+			continue
+		}
+		src, err := os.ReadFile(t.Source)
+		if err != nil {
+			return err
+		}
+		current := commentLines(string(src))
+		if t.SyncedHash == "" {
+			fmt.Printf("%s: never synced; translate against the current English comments\n\n", t.Translation)
+			continue
+		}
+		old, err := gitBlob(t.SyncedHash)
+		if err != nil {
+			fmt.Printf("%s: English text of %s is unavailable: %v\n\n", t.Translation, t.SyncedHash, err)
+			continue
+		}
+		diff := textdiff.Unified(t.Source+"@"+t.SyncedHash[:7], t.Source, commentLines(old), current)
+		if diff == "" {
+			fmt.Printf("%s: only code changed since the last sync\n\n", t.Translation)
+			continue
+		}
+		fmt.Println(diff)
+	}
+	return nil
+}
+
+func main() {
+	locale := flag.String("locale", "zh", "locale of the translations to check")
+	asJSON := flag.Bool("json", false, "print the status as JSON instead of a table")
+	showDiff := flag.Bool("diff", false, "show the English comment changes of stale translations")
+	sync := flag.Bool("sync", false, "record the current English sources of the given examples as translated")
+	flag.Parse()
+
+	ids, err := examplelist.IDs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if flag.NArg() > 0 {
+		known := make(map[string]bool)
+		for _, id := range ids {
+			known[id] = true
+		}
+		for _, id := range flag.Args() {
+			if !known[id] {
+				fmt.Fprintf(os.Stderr, "unknown example %q\n", id)
+				os.Exit(2)
+			}
+		}
+		ids = flag.Args()
+	}
+	if *sync && flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "-sync needs the IDs of the examples whose translation was updated")
+		os.Exit(2)
+	}
+
+	if err := run(ids, *locale, *sync, *showDiff, *asJSON); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run does what the flags ask for with the translations of the examples ids.
+func run(ids []string, locale string, sync, showDiff, asJSON bool) error {
+	synced, err := readManifest(locale)
+	if err != nil {
+		return err
+	}
+	translations, err := translationStatus(ids, locale, synced)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sync:
+		for _, t := range translations {
+			if t.Status == statusMissing {
+				fmt.Fprintf(os.Stderr, "skipping %s: no translation\n", t.Source)
+				continue
+			}
+			synced[t.Source] = t.CurrentHash
+			fmt.Printf("synced %s\n", t.Translation)
+		}
+		return writeManifest(locale, synced)
+	case showDiff:
+		return printDiffs(translations)
+	case asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(translations)
+	default:
+		return printTable(translations)
+	}
+}
@@ -1,83 +1,991 @@
-// Uploads the generated site from the public/ directory to the S3 bucket from
-// which it's served.
-// To invoke this program, the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
-// env vars have to be set appropriately, and the -region and -bucket flags
-// have to be passed in.
+// Syncs the generated site from the public/ directory to where it's hosted.
+// The -target flag picks where that is:
+//
+//	s3       the S3 bucket from which gobyexample.com is served (the default)
+//	dir      a local directory, mirrored like rsync --delete would
+//	tar.gz   a gzipped tarball of the site, e.g. for an internal mirror
+//	zip      a zip archive of the site
+//
+// Only files whose contents differ from what the target already has are
+// uploaded, and with -delete, objects that no longer exist locally (e.g. pages
+// of removed examples) are deleted. Uploads run concurrently and are retried
+// with backoff when they fail. -dry-run prints what would change without
+// changing anything.
+//
+// For S3, the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env vars have to be
+// set appropriately, and the -region and -bucket flags have to be passed in.
+// -endpoint points the program at an S3-compatible server other than AWS, such
+// as a local stand-in used for testing. The other targets write to -out.
+//
+// With -versioned, the s3 and dir targets keep every deploy as a release of
+// its own under releases/<version>/, and switch to it only once it's complete
+// (see releaseStore). -list-releases shows the releases, and
+// -rollback <version> switches back to an earlier one.
+//
+// Every object gets a Content-Type and a Cache-Control header, and with
+// -encoding, text files are stored compressed with the matching
+// Content-Encoding header. Only S3 keeps the headers.
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"mime"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
+// contentTypes maps the extensions used by the site to their content types.
+// Pages generated with -naming bare have no extension, so they're HTML too.
+var contentTypes = map[string]string{
+	"":      "text/html; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".js":   "text/javascript; charset=utf-8",
+	".json": "application/json",
+	".svg":  "image/svg+xml",
+	".ico":  "image/x-icon",
+	".png":  "image/png",
+	".txt":  "text/plain; charset=utf-8",
+	".xml":  "application/xml",
+}
+
 // guessContentType guesses the HTTP content type appropriate for the given
-// filename.
+// filename, falling back to the system MIME table for extensions the site
+// doesn't normally use.
 func guessContentType(filename string) string {
-	switch filepath.Ext(filename) {
-	case ".ico":
-		return "image/x-icon"
-	case ".png":
-		return "image/png"
-	case ".css":
-		return "text/css"
-	default:
-		return "text/html"
+	ext := strings.ToLower(filepath.Ext(filename))
+	if t, ok := contentTypes[ext]; ok {
+		return t
 	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
 }
 
-func main() {
-	region := flag.String("region", "", "S3 region")
-	bucket := flag.String("bucket", "", "S3 bucket name")
-	flag.Parse()
+// cachePolicy is the Cache-Control header of the objects whose key matches
+// pattern.
+type cachePolicy struct {
+	pattern *regexp.Regexp
+	value   string
+}
 
-	if len(*region) == 0 || len(*bucket) == 0 {
-		log.Fatalf("region and bucket must be specified [region=%s, bucket=%s]", *region, *bucket)
-	}
+// cachePolicies are tried in order and the first match wins. Assets with a
+// content hash in their name (site.3f2a9c1e.css) never change, so they can be
+// cached for good; pages change whenever an example does and are kept fresh.
+var cachePolicies = []cachePolicy{
+	{regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`), "public, max-age=31536000, immutable"},
+	{regexp.MustCompile(`\.(png|ico|svg)$`), "public, max-age=86400"},
+	{regexp.MustCompile(`\.(css|js)$`), "public, max-age=3600"},
+	{regexp.MustCompile(`.*`), "public, max-age=300"},
+}
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(*region))
-	if err != nil {
-		log.Fatal(err)
+func cacheControl(key string) string {
+	for _, policy := range cachePolicies {
+		if policy.pattern.MatchString(key) {
+			return policy.value
+		}
 	}
+	return ""
+}
 
-	client := s3.NewFromConfig(cfg)
+// compressible reports whether objects of the given content type are worth
+// storing compressed; images like PNG are compressed already.
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.HasPrefix(contentType, "application/json") ||
+		strings.HasPrefix(contentType, "application/xml") ||
+		strings.HasPrefix(contentType, "image/svg+xml")
+}
 
-	// The whole contents of the public/ directory are uploaded. This code assumes
-	// the directory structure is flat - there are no subdirectories.
-	publicDir := "./public/"
-	c, err := os.ReadDir(publicDir)
+// sidecarExts are the extensions of pre-compressed copies of site files, e.g.
+// site.css.br made with `brotli -k`. They're uploaded in place of the file
+// they compress rather than as objects of their own.
+var sidecarExts = map[string]string{"gzip": ".gz", "br": ".br"}
+
+// encode returns the body to upload for a file stored with encoding. A
+// pre-compressed sidecar is used if there is one; gzip can also be done here,
+// but there's no brotli encoder in the standard library, so -encoding br needs
+// the sidecars to exist.
+func encode(path string, data []byte, encoding string) ([]byte, error) {
+	sidecar, err := os.ReadFile(path + sidecarExts[encoding])
+	if err == nil {
+		return sidecar, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("no %s%s; compress the site first, e.g. with brotli -k", path, sidecarExts[encoding])
+	}
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
 	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	for _, entry := range c {
-		if !entry.IsDir() {
-			file, err := os.Open(filepath.Join(publicDir, entry.Name()))
+// localFile is a file of the generated site, keyed in the bucket by its
+// slash-separated path within the site directory, along with the body and
+// headers it's uploaded with.
+type localFile struct {
+	key             string
+	path            string
+	body            []byte
+	md5             string
+	contentType     string
+	cacheControl    string
+	contentEncoding string
+}
+
+// localFiles walks dir recursively, since pages generated with -naming dir
+// live in subdirectories (json/index.html). With a non-empty encoding,
+// compressible files are encoded with it.
+func localFiles(dir, encoding string) (map[string]localFile, error) {
+	files := make(map[string]localFile)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if isSidecar(path) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		file := localFile{
+			key:          key,
+			path:         path,
+			contentType:  guessContentType(key),
+			cacheControl: cacheControl(key),
+		}
+		file.body, err = os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if encoding != "" && compressible(file.contentType) {
+			file.body, err = encode(path, file.body, encoding)
 			if err != nil {
-				log.Fatal(err)
+				return err
 			}
-			defer file.Close()
+			file.contentEncoding = encoding
+		}
+		sum := md5.Sum(file.body)
+		file.md5 = hex.EncodeToString(sum[:])
+		files[key] = file
+		return nil
+	})
+	return files, err
+}
+
+// isSidecar reports whether path is a pre-compressed copy of another file.
+func isSidecar(path string) bool {
+	for _, ext := range sidecarExts {
+		if strings.HasSuffix(path, ext) {
+			if _, err := os.Stat(strings.TrimSuffix(path, ext)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// target is a place the site is published to. Its methods may be called
+// concurrently.
+type target interface {
+	// list returns the MD5 of every object the target already has, by key.
+	list(ctx context.Context) (map[string]string, error)
+	put(ctx context.Context, file localFile) error
+	delete(ctx context.Context, keys []string) error
+	// close finishes publishing once every put and delete is done.
+	close() error
+}
+
+// releaseStore is implemented by targets that can keep several versions of the
+// site side by side and switch between them quickly.
+type releaseStore interface {
+	// release returns the target a new version of the site is uploaded to.
+	release(version string) target
+	// releases returns the versions that have been uploaded, oldest first.
+	releases(ctx context.Context) ([]string, error)
+	// current returns the version being served, or "" if there is none.
+	current(ctx context.Context) (string, error)
+	// activate switches the served site to version.
+	activate(ctx context.Context, version string) error
+}
+
+// releasesDir holds the releases of a versioned target, and currentName is
+// the pointer to the release being served. Unversioned syncs leave both alone.
+const (
+	releasesDir = "releases"
+	currentName = "current"
+)
+
+func reservedKey(key string) bool {
+	return key == currentName || strings.HasPrefix(key, releasesDir+"/")
+}
+
+// s3Target publishes to an S3 bucket, under prefix if it's a release.
+type s3Target struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
 
-			contentType := guessContentType(entry.Name())
-			log.Printf("Uploading %s (%s)", entry.Name(), contentType)
+// list lists every object in the bucket. For objects uploaded in a single
+// PUT, as this program does, the ETag is the MD5 of the contents.
+func (t s3Target) list(ctx context.Context) (map[string]string, error) {
+	etags := make(map[string]string)
+	paginator := s3.NewListObjectsV2Paginator(t.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(t.bucket),
+		Prefix: aws.String(t.prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			key := strings.TrimPrefix(aws.ToString(object.Key), t.prefix)
+			if t.prefix == "" && reservedKey(key) {
+				continue
+			}
+			etags[key] = strings.Trim(aws.ToString(object.ETag), `"`)
+		}
+	}
+	return etags, nil
+}
+
+// plan is the set of changes that brings the target in sync with the site.
+type plan struct {
+	uploads   []localFile
+	deletes   []string
+	unchanged int
+}
 
-			cfg := &s3.PutObjectInput{
-				Bucket:      bucket,
-				Key:         aws.String(entry.Name()),
-				Body:        file,
-				ContentType: aws.String(contentType),
+// makePlan compares contents only; headers aren't part of the ETag, so after
+// changing a policy above, -force is needed to apply it to unchanged files.
+func makePlan(local map[string]localFile, remote map[string]string, deleteRemote, force bool) plan {
+	var p plan
+	for key, file := range local {
+		if etag, ok := remote[key]; ok && etag == file.md5 && !force {
+			p.unchanged++
+			continue
+		}
+		p.uploads = append(p.uploads, file)
+	}
+	if deleteRemote {
+		for key := range remote {
+			if _, ok := local[key]; !ok {
+				p.deletes = append(p.deletes, key)
 			}
+		}
+	}
+	sort.Slice(p.uploads, func(i, j int) bool { return p.uploads[i].key < p.uploads[j].key })
+	sort.Strings(p.deletes)
+	return p
+}
 
-			_, err = client.PutObject(context.TODO(), cfg)
-			if err != nil {
-				log.Fatal(err)
+func (p plan) print(remote map[string]string) {
+	for _, file := range p.uploads {
+		reason := "changed"
+		if _, ok := remote[file.key]; !ok {
+			reason = "new"
+		}
+		fmt.Printf("upload %s (%s; %s)\n", file.key, reason, file.headers())
+	}
+	for _, key := range p.deletes {
+		fmt.Printf("delete %s\n", key)
+	}
+	fmt.Printf("%d to upload, %d to delete, %d unchanged\n", len(p.uploads), len(p.deletes), p.unchanged)
+}
+
+// headers describes the headers file is uploaded with, for the log.
+func (file localFile) headers() string {
+	h := file.contentType + ", " + file.cacheControl
+	if file.contentEncoding != "" {
+		h += ", " + file.contentEncoding
+	}
+	return h
+}
+
+func (t s3Target) put(ctx context.Context, file localFile) error {
+	input := &s3.PutObjectInput{
+		Bucket:       aws.String(t.bucket),
+		Key:          aws.String(t.prefix + file.key),
+		Body:         bytes.NewReader(file.body),
+		ContentType:  aws.String(file.contentType),
+		CacheControl: aws.String(file.cacheControl),
+	}
+	if file.contentEncoding != "" {
+		input.ContentEncoding = aws.String(file.contentEncoding)
+	}
+	_, err := t.client.PutObject(ctx, input)
+	return err
+}
+
+// delete deletes keys in batches of the 1000 objects DeleteObjects accepts.
+func (t s3Target) delete(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		var objects []types.ObjectIdentifier
+		for _, key := range keys[:n] {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(t.prefix + key)})
+		}
+		out, err := t.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(t.bucket),
+			Delete: &types.Delete{Objects: objects, Quiet: true},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("deleting %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+func (t s3Target) close() error { return nil }
+
+// The served release of a bucket is recorded in the routing rules of the
+// bucket website: a request for a key the bucket doesn't have, which is every
+// key of the site once it's versioned, is redirected to the same key in the
+// release. Rewriting the website configuration switches releases in a single
+// request, and so atomically. The redirects are temporary ones, so that
+// browsers and caches ask again after a switch.
+//
+// Objects at the root of the bucket, like those an unversioned sync leaves,
+// are served as they are rather than redirected, so activating a release
+// deletes them once the release is being served.
+func (t s3Target) release(version string) target {
+	return t.releaseTarget(version)
+}
+
+func (t s3Target) releaseTarget(version string) s3Target {
+	return s3Target{client: t.client, bucket: t.bucket, prefix: releasesDir + "/" + version + "/"}
+}
+
+func (t s3Target) releases(ctx context.Context) ([]string, error) {
+	var versions []string
+	paginator := s3.NewListObjectsV2Paginator(t.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(t.bucket),
+		Prefix:    aws.String(releasesDir + "/"),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, prefix := range page.CommonPrefixes {
+			versions = append(versions, path.Base(aws.ToString(prefix.Prefix)))
+		}
+	}
+	sort.Strings(versions)
+	return versions, nil
+}
+
+// website returns the website configuration of the bucket, or an empty one if
+// the bucket has none yet.
+func (t s3Target) website(ctx context.Context) (*s3.GetBucketWebsiteOutput, error) {
+	out, err := t.client.GetBucketWebsite(ctx, &s3.GetBucketWebsiteInput{Bucket: aws.String(t.bucket)})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchWebsiteConfiguration" {
+		return &s3.GetBucketWebsiteOutput{}, nil
+	}
+	return out, err
+}
+
+// releaseRule reports whether rule is one of the rules that activate writes,
+// and if so, which release it redirects to.
+func releaseRule(rule types.RoutingRule) (version string, ok bool) {
+	if rule.Redirect == nil {
+		return "", false
+	}
+	to := aws.ToString(rule.Redirect.ReplaceKeyPrefixWith)
+	if rule.Redirect.ReplaceKeyWith != nil {
+		to = aws.ToString(rule.Redirect.ReplaceKeyWith)
+	}
+	if !strings.HasPrefix(to, releasesDir+"/") {
+		return "", false
+	}
+	return strings.SplitN(strings.TrimPrefix(to, releasesDir+"/"), "/", 2)[0], true
+}
+
+func (t s3Target) current(ctx context.Context) (string, error) {
+	website, err := t.website(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range website.RoutingRules {
+		if version, ok := releaseRule(rule); ok {
+			return version, nil
+		}
+	}
+	return "", nil
+}
+
+// releaseRules are the routing rules that serve version. Without read access
+// to the whole bucket, S3 answers 403 rather than 404 for a missing key, so
+// both are redirected. A key missing from the release itself gets its 404
+// page rather than a redirect to a key under the release again.
+func releaseRules(version string) []types.RoutingRule {
+	prefix := releasesDir + "/" + version + "/"
+	var rules []types.RoutingRule
+	for _, code := range []string{"404", "403"} {
+		rules = append(rules, types.RoutingRule{
+			Condition: &types.Condition{HttpErrorCodeReturnedEquals: aws.String(code), KeyPrefixEquals: aws.String(releasesDir + "/")},
+			Redirect:  &types.Redirect{HttpRedirectCode: aws.String("302"), ReplaceKeyWith: aws.String(prefix + "404.html")},
+		})
+	}
+	for _, code := range []string{"404", "403"} {
+		rules = append(rules, types.RoutingRule{
+			Condition: &types.Condition{HttpErrorCodeReturnedEquals: aws.String(code)},
+			Redirect:  &types.Redirect{HttpRedirectCode: aws.String("302"), ReplaceKeyPrefixWith: aws.String(prefix)},
+		})
+	}
+	return rules
+}
+
+func (t s3Target) activate(ctx context.Context, version string) error {
+	release := t.releaseTarget(version)
+	files, err := release.list(ctx)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("release %s is empty", version)
+	}
+	website, err := t.website(ctx)
+	if err != nil {
+		return err
+	}
+	// Rules of the bucket's own are kept, after those of the release.
+	rules := releaseRules(version)
+	for _, rule := range website.RoutingRules {
+		if _, ok := releaseRule(rule); !ok {
+			rules = append(rules, rule)
+		}
+	}
+	index := website.IndexDocument
+	if index == nil {
+		index = &types.IndexDocument{Suffix: aws.String("index.html")}
+	}
+	_, err = t.client.PutBucketWebsite(ctx, &s3.PutBucketWebsiteInput{
+		Bucket: aws.String(t.bucket),
+		WebsiteConfiguration: &types.WebsiteConfiguration{
+			IndexDocument: index,
+			ErrorDocument: &types.ErrorDocument{Key: aws.String(release.prefix + "404.html")},
+			RoutingRules:  rules,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("switching the bucket website to release %s: %v", version, err)
+	}
+	shadowing, err := t.list(ctx)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for key := range shadowing {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return t.delete(ctx, keys)
+}
+
+// dirTarget mirrors the site into a local directory, e.g. the document root of
+// a web server. Headers can't be kept, so the server has to derive them.
+type dirTarget struct {
+	dir string
+	// versioned is set for releases, which live in a directory of their own,
+	// so nothing in dir is reserved.
+	versioned bool
+}
+
+func (t dirTarget) list(ctx context.Context) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := filepath.WalkDir(t.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(t.dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !t.versioned && reservedKey(key) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := md5.Sum(data)
+		sums[key] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return sums, nil
+	}
+	return sums, err
+}
+
+func (t dirTarget) put(ctx context.Context, file localFile) error {
+	path := filepath.Join(t.dir, filepath.FromSlash(file.key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Write next to the destination and rename, so a server reading the
+	// mirror never sees a partly written file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, file.body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// delete removes the files of keys, along with directories left empty.
+func (t dirTarget) delete(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		path := filepath.Join(t.dir, filepath.FromSlash(key))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for dir := filepath.Dir(path); dir != filepath.Clean(t.dir); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
 			}
 		}
 	}
+	return nil
+}
+
+func (t dirTarget) close() error { return nil }
+
+// The served release of a directory is the symlink <dir>/current, which the web
+// server uses as its document root. A new link is renamed over the old one,
+// which switches releases atomically.
+func (t dirTarget) release(version string) target {
+	return dirTarget{dir: filepath.Join(t.dir, releasesDir, version), versioned: true}
+}
+
+func (t dirTarget) releases(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(t.dir, releasesDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+	return versions, err
+}
+
+func (t dirTarget) current(ctx context.Context) (string, error) {
+	link, err := os.Readlink(filepath.Join(t.dir, currentName))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return filepath.Base(link), err
+}
+
+func (t dirTarget) activate(ctx context.Context, version string) error {
+	link := filepath.Join(t.dir, currentName)
+	tmp := link + ".tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(filepath.Join(releasesDir, version), tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, link)
+}
+
+// archiveTarget packs the site into a tar.gz or zip file, which is written by
+// close. An archive always starts out empty, so every file is put.
+type archiveTarget struct {
+	path   string
+	format string
+
+	mu    sync.Mutex
+	files []localFile
+}
+
+func (t *archiveTarget) list(ctx context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (t *archiveTarget) put(ctx context.Context, file localFile) error {
+	t.mu.Lock()
+	t.files = append(t.files, file)
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *archiveTarget) delete(ctx context.Context, keys []string) error { return nil }
+
+// close writes the archive, with the files sorted by key so that the same site
+// always produces the same archive.
+func (t *archiveTarget) close() error {
+	sort.Slice(t.files, func(i, j int) bool { return t.files[i].key < t.files[j].key })
+	f, err := os.Create(t.path)
+	if err != nil {
+		return err
+	}
+	if t.format == "zip" {
+		err = writeZip(f, t.files)
+	} else {
+		err = writeTarGz(f, t.files)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// archiveTime is the modification time recorded in archives. The build time
+// would make every archive differ.
+var archiveTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func writeTarGz(w io.Writer, files []localFile) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name:    file.key,
+			Mode:    0644,
+			Size:    int64(len(file.body)),
+			ModTime: archiveTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.body); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZip(w io.Writer, files []localFile) error {
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		hdr := &zip.FileHeader{Name: file.key, Method: zip.Deflate, Modified: archiveTime}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(file.body); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// uploadWithRetry uploads file, retrying failures with exponential backoff.
+func uploadWithRetry(ctx context.Context, t target, file localFile, retries int) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := t.put(ctx, file)
+		if err == nil || attempt == retries {
+			return err
+		}
+		log.Printf("Retrying %s in %v: %v", file.key, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// transfer is what uploadAll managed to upload.
+type transfer struct {
+	objects int
+	bytes   int64
+	errs    []error
+}
+
+// uploadAll uploads files using jobs concurrent uploaders, logging progress as
+// each file completes.
+func uploadAll(ctx context.Context, t target, files []localFile, jobs, retries int) transfer {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		done transfer
+	)
+	queue := make(chan localFile)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				err := uploadWithRetry(ctx, t, file, retries)
+				mu.Lock()
+				status := "Uploaded"
+				if err != nil {
+					status = "Failed"
+					done.errs = append(done.errs, fmt.Errorf("uploading %s: %v", file.key, err))
+				} else {
+					done.objects++
+					done.bytes += int64(len(file.body))
+				}
+				log.Printf("[%d/%d] %s %s (%d bytes; %s)", done.objects+len(done.errs), len(files),
+					status, file.key, len(file.body), file.headers())
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		queue <- file
+	}
+	close(queue)
+	wg.Wait()
+	return done
+}
+
+// newS3Target connects to the bucket, on AWS unless endpoint is given.
+func newS3Target(ctx context.Context, region, bucket, endpoint string) (s3Target, error) {
+	if len(region) == 0 || len(bucket) == 0 {
+		return s3Target{}, fmt.Errorf("region and bucket must be specified [region=%s, bucket=%s]", region, bucket)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		return s3Target{}, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(endpoint)
+			// Local stand-ins generally don't resolve bucket subdomains.
+			o.UsePathStyle = true
+		}
+	})
+	return s3Target{client: client, bucket: bucket}, nil
+}
+
+// printReleases lists the releases of store, marking the one being served.
+func printReleases(ctx context.Context, store releaseStore) error {
+	versions, err := store.releases(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := store.current(ctx)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		marker := " "
+		if version == current {
+			marker = "*"
+		}
+		fmt.Printf("%s %s\n", marker, version)
+	}
+	return nil
+}
+
+// rollback switches store back to an earlier release.
+func rollback(ctx context.Context, store releaseStore, version string, dryRun bool) error {
+	versions, err := store.releases(ctx)
+	if err != nil {
+		return err
+	}
+	if i := sort.SearchStrings(versions, version); i == len(versions) || versions[i] != version {
+		return fmt.Errorf("no release %q; see -list-releases", version)
+	}
+	current, err := store.current(ctx)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("activate %s (current: %s)\n", version, current)
+		return nil
+	}
+	if err := store.activate(ctx, version); err != nil {
+		return err
+	}
+	log.Printf("Rolled back from release %s to %s", current, version)
+	return nil
+}
+
+func main() {
+	targetName := flag.String("target", "s3", "where to publish the site: s3, dir, tar.gz or zip")
+	out := flag.String("out", "", "directory (-target dir) or archive file (-target tar.gz or zip) to write")
+	region := flag.String("region", "", "S3 region")
+	bucket := flag.String("bucket", "", "S3 bucket name")
+	endpoint := flag.String("endpoint", "", "URL of an S3-compatible endpoint to use instead of AWS, e.g. http://127.0.0.1:9000")
+	deleteRemote := flag.Bool("delete", false, "delete objects that don't exist in public/")
+	dryRun := flag.Bool("dry-run", false, "print the changes that would be made without making them")
+	encoding := flag.String("encoding", "", "store text files compressed with this Content-Encoding: gzip or br (s3 target only; needs .br files made beforehand)")
+	force := flag.Bool("force", false, "upload every file even if its contents are unchanged, e.g. to apply new headers")
+	jobs := flag.Int("j", 8, "number of concurrent uploads")
+	retries := flag.Int("retries", 3, "number of times a failed upload is retried")
+	versioned := flag.Bool("versioned", false, "upload to a new release and switch to it once complete (s3 and dir targets)")
+	version := flag.String("version", time.Now().UTC().Format("20060102-150405"), "name of the release uploaded with -versioned")
+	listReleases := flag.Bool("list-releases", false, "list the releases, marking the current one with *")
+	rollbackTo := flag.String("rollback", "", "switch to an earlier release instead of uploading")
+	flag.Parse()
+
+	if *jobs < 1 {
+		log.Fatalf("-j must be at least 1, got %d", *jobs)
+	}
+	if _, ok := sidecarExts[*encoding]; *encoding != "" && !ok {
+		log.Fatalf("unknown encoding %q; use gzip or br", *encoding)
+	}
+	if *encoding != "" && *targetName != "s3" {
+		// the other targets have no way to record a Content-Encoding, so the
+		// compressed bytes would be served under the plain file name
+		log.Fatalf("-encoding needs -target s3")
+	}
+
+	ctx := context.TODO()
+	var t target
+	switch *targetName {
+	case "s3":
+		s3t, err := newS3Target(ctx, *region, *bucket, *endpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		t = s3t
+	case "dir", "tar.gz", "zip":
+		if *out == "" {
+			log.Fatalf("-target %s needs -out", *targetName)
+		}
+		if *targetName == "dir" {
+			t = dirTarget{dir: *out}
+		} else {
+			t = &archiveTarget{path: *out, format: *targetName}
+		}
+	default:
+		log.Fatalf("unknown target %q; use s3, dir, tar.gz or zip", *targetName)
+	}
+
+	store, ok := t.(releaseStore)
+	if (*versioned || *listReleases || *rollbackTo != "") && !ok {
+		log.Fatalf("-target %s doesn't keep releases", *targetName)
+	}
+	switch {
+	case *listReleases:
+		if err := printReleases(ctx, store); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *rollbackTo != "":
+		if err := rollback(ctx, store, *rollbackTo, *dryRun); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case *versioned:
+		// "." and ".." would name the releases directory or the one above it.
+		if v := *version; v == "" || v == "." || v == ".." || v == currentName || strings.ContainsAny(v, `/\`) {
+			log.Fatalf("invalid release name %q", *version)
+		}
+		versions, err := store.releases(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Uploading into an existing release would change it in place, and
+		// if it's the one being served, visitors would see it half-updated.
+		if i := sort.SearchStrings(versions, *version); i < len(versions) && versions[i] == *version {
+			log.Fatalf("release %q already exists; pick another -version", *version)
+		}
+		t = store.release(*version)
+	case *targetName == "s3":
+		// Objects synced to the root would be served instead of the release.
+		current, err := store.current(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if current != "" {
+			log.Fatalf("the bucket serves release %s; upload with -versioned", current)
+		}
+	}
+
+	publicDir := "./public/"
+	local, err := localFiles(publicDir, *encoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+	remote, err := t.list(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p := makePlan(local, remote, *deleteRemote, *force)
+	if *dryRun {
+		p.print(remote)
+		if *versioned {
+			fmt.Printf("activate %s\n", *version)
+		}
+		return
+	}
+	start := time.Now()
+	done := uploadAll(ctx, t, p.uploads, *jobs, *retries)
+	if len(done.errs) > 0 {
+		// Keep the old objects around while the new site is incomplete.
+		for _, err := range done.errs {
+			log.Print(err)
+		}
+		log.Fatalf("%d of %d uploads failed; nothing was deleted", len(done.errs), len(p.uploads))
+	}
+	for _, key := range p.deletes {
+		log.Printf("Deleting %s", key)
+	}
+	if err := t.delete(ctx, p.deletes); err != nil {
+		log.Fatal(err)
+	}
+	if err := t.close(); err != nil {
+		log.Fatal(err)
+	}
+	if *versioned {
+		previous, err := store.current(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := store.activate(ctx, *version); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Activated release %s (previous: %s)", *version, previous)
+	}
+	log.Printf("%d objects (%d bytes) uploaded, %d deleted, %d unchanged in %v",
+		done.objects, done.bytes, len(p.deletes), p.unchanged, time.Since(start).Round(time.Millisecond))
 }
@@ -0,0 +1,1269 @@
+// Runs the commands of each example's .sh transcript and checks that their
+// output still matches what the transcript shows.
+//
+// A transcript is a sequence of `$ command` lines, each followed by the output
+// it's expected to print. Lines starting with # are commentary and are
+// skipped, along with the blank lines around them. The commands of a
+// transcript run in order in a single bash session, in a temporary copy of
+// the example's .go files, with stdout and stderr captured together as they'd
+// appear in a terminal, and nothing to read on stdin. The files the examples
+// write to /tmp, and TMPDIR, are kept in the copy too, so that sessions leave
+// the host's /tmp alone and don't share files. Commands are expected
+// to exit with the status the transcript shows for them: the one a following
+// `echo $?` prints, 1 for a `go run` that ends with the "exit status N" line
+// go run prints when the program fails, and otherwise 0.
+// A recorded line of just "..." stands for any number of lines, the way
+// transcripts elide long output, and a line of just ^C is where the command was
+// interrupted: it's sent SIGINT once the output recorded before it appears.
+//
+// The output of go test is compared with how long tests and benchmarks took
+// and the machine they ran on left out, and failing tests are reported as
+// such. Examples with _test.go files need transcripts that run both
+// go test -v and go test -bench.
+//
+// Output that changes from run to run, like timestamps or the order in which
+// goroutines print, is normalized by rules in a .verify file next to the
+// transcript, applied to the recorded and the actual output alike. The same
+// file declares the ports that server examples listen on and stands in for
+// the hosts that client examples fetch from, so that examples using the
+// network are verified without it, and it gives commands other exit statuses,
+// files to read on stdin, or signals to receive (see Harness).
+//
+// With -update, the output recorded for commands that print something else is
+// rewritten in place, keeping the commentary and what still matches.
+//
+// Usage:
+//
+//	tools/verify [-v] [-j N] [-timeout 2m] [example-id...]
+//	tools/verify -update [example-id...]
+//	tools/verify -race -leaks [example-id...]
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mmcgrana/gobyexample/tools/internal/examplelist"
+	"github.com/mmcgrana/gobyexample/tools/internal/textdiff"
+	"github.com/mmcgrana/gobyexample/tools/internal/transcript"
+)
+
+// Harness is what the .verify file next to a transcript sets up for it. The
+// file has one directive per line; blank lines and lines starting with # are
+// ignored:
+//
+//	replace REGEXP => REPLACEMENT
+//	range MIN MAX REGEXP
+//	unordered REGEXP
+//	listen PORT
+//	host NAME DIR
+//	status CODE[,CODE...] COMMAND
+//	stdin FILE COMMAND
+//	signal NAME DELAY COMMAND
+//	leaks [REGEXP]
+//
+// The first three are normalization rules (see transcript.Rule). listen declares that the
+// example serves on PORT: after a command started in the background, like
+// `go run server.go &`, the session waits for the port to accept connections
+// before running the next command, and transcripts listening on the same port
+// are verified one at a time. host answers the example's requests to
+// http://NAME with the files of DIR, a directory of the repository, through a
+// stand-in proxy; requests to other hosts fail rather than reach the network.
+//
+// The last three apply to the commands written as COMMAND after the $ in the
+// transcript. Every command is expected to exit with the status the transcript
+// shows for it (see recordedStatus), or 0, unless status lists the ones it may
+// exit with; a pipeline's status is that of its last
+// command, as in a terminal. stdin makes the command read FILE, in the
+// example's directory, as its standard input instead of nothing. signal sends
+// the command the signal NAME, like INT or TERM, DELAY (a Go duration) after
+// the output before its ^C line has appeared or, if it has none, after it
+// started; a ^C line on its own sends INT right away.
+//
+// leaks declares that the example leaves goroutines whose stacks match REGEXP,
+// or any goroutines without one, running on purpose when main returns, which
+// -leaks would otherwise report.
+type Harness struct {
+	Rules    []transcript.Rule
+	Ports    []int
+	Hosts    map[string]string // host name -> directory
+	Commands map[string]*Expect
+	Leaks    []*regexp.Regexp
+}
+
+// Expect is how a command of a transcript is run and the statuses it may exit
+// with.
+type Expect struct {
+	Line     int   // line of the first directive about the command
+	Statuses []int // just 0 if empty
+	Stdin    string
+	Signal   string
+	Delay    time.Duration
+}
+
+// command returns the Expect of command, adding it if need be.
+func (h *Harness) command(command string, line int) *Expect {
+	if h.Commands == nil {
+		h.Commands = make(map[string]*Expect)
+	}
+	e := h.Commands[command]
+	if e == nil {
+		e = &Expect{Line: line}
+		h.Commands[command] = e
+	}
+	return e
+}
+
+// expectFor returns what the harness says about command.
+func (h Harness) expectFor(command string) Expect {
+	if e := h.Commands[command]; e != nil {
+		return *e
+	}
+	return Expect{}
+}
+
+// allows reports whether the command may exit with status.
+func (e Expect) allows(status int) bool {
+	if len(e.Statuses) == 0 {
+		return status == 0
+	}
+	for _, s := range e.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// statusList describes the statuses the command may exit with, e.g. "0 or 1".
+func (e Expect) statusList() string {
+	if len(e.Statuses) == 0 {
+		return "0"
+	}
+	var codes []string
+	for _, s := range e.Statuses {
+		codes = append(codes, strconv.Itoa(s))
+	}
+	return strings.Join(codes, " or ")
+}
+
+var goRunStatusPat = regexp.MustCompile(`^exit status \d+$`)
+
+// recordedStatus returns the exit status that the transcript itself shows for
+// the command of steps[i]: what a following `echo $?` prints, or 1 for a
+// go run whose last line reports the status the program exited with, which
+// go run exits with in its place.
+func recordedStatus(steps []transcript.Step, i int) (int, bool) {
+	if i+1 < len(steps) && steps[i+1].Command == "echo $?" && len(steps[i+1].Output) == 1 {
+		if status, err := strconv.Atoi(steps[i+1].Output[0]); err == nil {
+			return status, true
+		}
+	}
+	output := steps[i].Output
+	if strings.HasPrefix(steps[i].Command, "go run ") && len(output) > 0 && goRunStatusPat.MatchString(output[len(output)-1]) {
+		return 1, true
+	}
+	return 0, false
+}
+
+// signalNames are the signals a signal directive can send.
+var signalNames = map[string]bool{
+	"INT": true, "TERM": true, "HUP": true, "QUIT": true, "USR1": true, "USR2": true, "KILL": true,
+}
+
+var ruleEscapes = strings.NewReplacer(`\n`, "\n", `\t`, "\t")
+
+// harnessPath returns the .verify file of a transcript, e.g. json.verify for
+// json.sh.
+func harnessPath(shPath string) string {
+	return strings.TrimSuffix(shPath, ".sh") + ".verify"
+}
+
+// loadHarness reads the .verify file of a transcript; most transcripts have
+// none.
+func loadHarness(shPath string) (Harness, error) {
+	var h Harness
+	path := harnessPath(shPath)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return h, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := transcript.Rule{Line: i + 1}
+		var pattern string
+		fields := strings.SplitN(line, " ", 2)
+		kind, args := fields[0], ""
+		if len(fields) == 2 {
+			args = fields[1]
+		}
+		switch kind {
+		case "listen":
+			port, err := strconv.Atoi(args)
+			if err != nil || port <= 0 || port > 65535 {
+				return h, fmt.Errorf("%s:%d: want listen PORT", path, rule.Line)
+			}
+			h.Ports = append(h.Ports, port)
+			continue
+		case "host":
+			fields := strings.Fields(args)
+			if len(fields) != 2 {
+				return h, fmt.Errorf("%s:%d: want host NAME DIR", path, rule.Line)
+			}
+			if info, err := os.Stat(fields[1]); err != nil || !info.IsDir() {
+				return h, fmt.Errorf("%s:%d: %s is not a directory", path, rule.Line, fields[1])
+			}
+			if h.Hosts == nil {
+				h.Hosts = make(map[string]string)
+			}
+			h.Hosts[fields[0]] = fields[1]
+			continue
+		case "status":
+			fields := strings.SplitN(args, " ", 2)
+			if len(fields) < 2 {
+				return h, fmt.Errorf("%s:%d: want status CODE[,CODE...] COMMAND", path, rule.Line)
+			}
+			var codes []int
+			for _, field := range strings.Split(fields[0], ",") {
+				code, err := strconv.Atoi(field)
+				if err != nil {
+					return h, fmt.Errorf("%s:%d: invalid status %q", path, rule.Line, field)
+				}
+				codes = append(codes, code)
+			}
+			h.command(strings.TrimSpace(fields[1]), rule.Line).Statuses = codes
+			continue
+		case "stdin":
+			fields := strings.SplitN(args, " ", 2)
+			if len(fields) < 2 {
+				return h, fmt.Errorf("%s:%d: want stdin FILE COMMAND", path, rule.Line)
+			}
+			file := filepath.Join(filepath.Dir(shPath), fields[0])
+			if info, err := os.Stat(file); err != nil || info.IsDir() {
+				return h, fmt.Errorf("%s:%d: %s is not a file", path, rule.Line, file)
+			}
+			file, err := filepath.Abs(file)
+			if err != nil {
+				return h, err
+			}
+			h.command(strings.TrimSpace(fields[1]), rule.Line).Stdin = file
+			continue
+		case "signal":
+			fields := strings.SplitN(args, " ", 3)
+			if len(fields) < 3 {
+				return h, fmt.Errorf("%s:%d: want signal NAME DELAY COMMAND", path, rule.Line)
+			}
+			name := strings.TrimPrefix(strings.ToUpper(fields[0]), "SIG")
+			if !signalNames[name] {
+				return h, fmt.Errorf("%s:%d: unknown signal %q", path, rule.Line, fields[0])
+			}
+			delay, err := time.ParseDuration(fields[1])
+			if err != nil {
+				return h, fmt.Errorf("%s:%d: %v", path, rule.Line, err)
+			}
+			e := h.command(strings.TrimSpace(fields[2]), rule.Line)
+			e.Signal, e.Delay = name, delay
+			continue
+		case "leaks":
+			leak, err := regexp.Compile(args)
+			if err != nil {
+				return h, fmt.Errorf("%s:%d: %v", path, rule.Line, err)
+			}
+			h.Leaks = append(h.Leaks, leak)
+			continue
+		case "replace":
+			parts := strings.SplitN(args, " =>", 2)
+			pattern = parts[0]
+			if len(parts) == 2 {
+				rule.Replacement = ruleEscapes.Replace(strings.TrimPrefix(parts[1], " "))
+			}
+		case "range":
+			fields := strings.SplitN(args, " ", 3)
+			if len(fields) < 3 {
+				return h, fmt.Errorf("%s:%d: want range MIN MAX REGEXP", path, rule.Line)
+			}
+			var errMin, errMax error
+			rule.Min, errMin = strconv.ParseFloat(fields[0], 64)
+			rule.Max, errMax = strconv.ParseFloat(fields[1], 64)
+			if errMin != nil || errMax != nil {
+				return h, fmt.Errorf("%s:%d: invalid range %s..%s", path, rule.Line, fields[0], fields[1])
+			}
+			pattern = fields[2]
+		case "unordered":
+			pattern = args
+		default:
+			return h, fmt.Errorf("%s:%d: unknown directive %q", path, rule.Line, kind)
+		}
+		rule.Kind = kind
+		rule.Pattern, err = regexp.Compile("(?m)" + strings.TrimSpace(pattern))
+		if err != nil {
+			return h, fmt.Errorf("%s:%d: %v", path, rule.Line, err)
+		}
+		if kind == "range" && rule.Pattern.NumSubexp() == 0 {
+			return h, fmt.Errorf("%s:%d: range needs a REGEXP with a (group) around the number", path, rule.Line)
+		}
+		h.Rules = append(h.Rules, rule)
+	}
+	return h, nil
+}
+
+// goTestRules normalize the output of every go test command, which reports
+// how long tests and benchmarks took, and on what machine.
+var goTestRules = []transcript.Rule{
+	replaceRule(`^(\s*--- (PASS|FAIL|SKIP): .+) \(\d+\.\d+s\)$`, "$1 (<elapsed>)"),
+	replaceRule(`^((ok  |FAIL)\t\S+\t)\d+\.\d+s$`, "$1<elapsed>"),
+	replaceRule(`^goos: \S+$`, "goos: <GOOS>"),
+	replaceRule(`^goarch: \S+$`, "goarch: <GOARCH>"),
+	replaceRule(`^cpu: .*\n`, ""),
+	replaceRule(`^(Benchmark\S+?)(-\d+)?\s+\d+\s+\d+(\.\d+)? ns/op.*$`, "$1 <result>"),
+}
+
+func replaceRule(pattern, replacement string) transcript.Rule {
+	return transcript.Rule{Kind: "replace", Pattern: regexp.MustCompile("(?m)" + pattern), Replacement: replacement}
+}
+
+// isGoTest reports whether command runs go test.
+func isGoTest(command string) bool {
+	return strings.HasPrefix(command, "go test")
+}
+
+var failedTestPat = regexp.MustCompile(`^\s*--- FAIL: (\S+)`)
+
+// failedTests returns the tests and benchmarks that go test reports as failed.
+func failedTests(output []string) []string {
+	var failed []string
+	for _, line := range output {
+		if m := failedTestPat.FindStringSubmatch(line); m != nil {
+			failed = append(failed, m[1])
+		}
+	}
+	return failed
+}
+
+// missingTestRuns returns the go test commands that the transcripts of an
+// example with tests don't run: go test -v for the tests and go test -bench
+// for the benchmarks, so that both are run and checked.
+func missingTestRuns(id string, paths []string) ([]string, error) {
+	tests, err := filepath.Glob(filepath.Join("examples", id, "*_test.go"))
+	if err != nil || len(tests) == 0 {
+		return nil, err
+	}
+	verbose, bench := false, false
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range transcript.Parse(string(src)) {
+			if !isGoTest(step.Command) {
+				continue
+			}
+			for _, arg := range strings.Fields(step.Command) {
+				verbose = verbose || arg == "-v" || arg == "-v=true"
+				bench = bench || strings.HasPrefix(arg, "-bench")
+			}
+		}
+	}
+	var missing []string
+	if !verbose {
+		missing = append(missing, "go test -v")
+	}
+	if !bench {
+		missing = append(missing, "go test -bench")
+	}
+	return missing, nil
+}
+
+// Result is the outcome of running one step.
+type Result struct {
+	Output []string
+	Status int
+}
+
+// newWorkspace copies the Go sources of an example into a temporary module,
+// so that both `go run` and `go test` work and nothing is written to the
+// repository. The example's files are in a directory of their own, named
+// after it, because transcripts list its contents. The session's temporary
+// files go in tmp, which stands in for /tmp: paths in /tmp that the examples'
+// sources name are rewritten to point there (see tmpPaths).
+// With leaks, the example's main is instrumented by instrumentMain.
+func newWorkspace(id string, leaks bool) (root, dir, tmp string, err error) {
+	root, err = os.MkdirTemp("", "gobyexample-verify-")
+	if err != nil {
+		return "", "", "", err
+	}
+	dir, tmp = filepath.Join(root, id), filepath.Join(root, "tmp")
+	for _, d := range []string{dir, tmp} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			return root, "", "", err
+		}
+	}
+	sources, err := filepath.Glob(filepath.Join("examples", id, "*.go"))
+	if err != nil {
+		return root, "", "", err
+	}
+	for _, src := range sources {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			return root, "", "", err
+		}
+		data = []byte(tmpPaths(tmp).Replace(string(data)))
+		if leaks && !strings.HasSuffix(src, "_test.go") {
+			if data, err = instrumentMain(src, data); err != nil {
+				return root, "", "", err
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, filepath.Base(src)), data, 0644); err != nil {
+			return root, "", "", err
+		}
+	}
+	init := exec.Command("go", "mod", "init", "examples")
+	init.Dir = root
+	if out, err := init.CombinedOutput(); err != nil {
+		return root, "", "", fmt.Errorf("go mod init: %v\n%s", err, out)
+	}
+	return root, dir, tmp, nil
+}
+
+// tmpPaths rewrites the paths in /tmp that examples and their transcripts
+// use, like /tmp/dat, to paths in tmp, so that sessions don't write to the
+// host's /tmp or to each other's files.
+func tmpPaths(tmp string) *strings.Replacer {
+	return strings.NewReplacer("/tmp/", tmp+"/")
+}
+
+// sessionFuncs are the helpers a session script uses to drive the examples.
+// __verify_await waits until text appears in the output written since an
+// offset, giving up after some seconds or once a process has exited.
+// __verify_listen waits until a port accepts connections, unless the process
+// that should listen on it has exited. curl leaves out its progress meter, as
+// it does when its output goes to a terminal.
+const sessionFuncs = `curl() { command curl -sS "$@"; }
+__verify_await() { # output offset text seconds [pid]
+	local end=$((SECONDS + $4))
+	until tail -c +$(($2 + 1)) "$1" | grep -qF -- "$3"; do
+		if [ $SECONDS -ge $end ] || { [ -n "$5" ] && ! kill -0 $5 2>/dev/null; }; then
+			return
+		fi
+		sleep 0.1
+	done
+}
+__verify_listen() { # port pid
+	until (exec 3<>/dev/tcp/127.0.0.1/$1) 2>/dev/null; do
+		kill -0 $2 2>/dev/null || return
+		sleep 0.1
+	done
+}
+`
+
+// How long to wait for the output an interrupted command prints before the
+// ^C line and, after it, for the output of its cleanup or of servers that
+// notice the interrupted client.
+const (
+	interruptWait = 60
+	interruptDone = 5
+)
+
+// shellQuote quotes s as a single word for bash.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// lastLine returns the last non-blank line of lines.
+func lastLine(lines []string) string {
+	for i := len(lines) - 1; i >= 0; i-- {
+		if strings.TrimSpace(lines[i]) != "" {
+			return lines[i]
+		}
+	}
+	return ""
+}
+
+// stepScript returns the session commands that run step. Commands to be
+// signalled run as a job of their own, so that the signal reaches just them
+// and the processes they started, the way Ctrl-C does in a terminal; the
+// process group is recorded in pgids so it's killed along with the session.
+// The ^C is printed without a newline, as the terminal echoes it.
+func stepScript(step transcript.Step, h Harness, tmp, output, pgids string) string {
+	var b strings.Builder
+	e := h.expectFor(step.Command)
+	command := tmpPaths(tmp).Replace(step.Command)
+	if e.Stdin != "" {
+		// Redirecting the session's input reaches every command of a
+		// pipeline, and jobs too.
+		fmt.Fprintf(&b, "exec 3<&0 < %s\n", shellQuote(e.Stdin))
+	}
+	before, after, interrupted := step.Interrupt()
+	switch {
+	case interrupted || e.Signal != "":
+		signal := e.Signal
+		if signal == "" {
+			signal = "INT"
+		}
+		fmt.Fprintf(&b, "__verify_off=$(wc -c < %s)\n", shellQuote(output))
+		fmt.Fprintf(&b, "set -m; %s & __verify_pid=$!; set +m\n", command)
+		fmt.Fprintf(&b, "echo $__verify_pid >> %s\n", shellQuote(pgids))
+		if interrupted {
+			fmt.Fprintf(&b, "__verify_await %s $__verify_off %s %d $__verify_pid\n",
+				shellQuote(output), shellQuote(lastLine(before)), interruptWait)
+		}
+		if e.Delay > 0 {
+			fmt.Fprintf(&b, "sleep %.3f\n", e.Delay.Seconds())
+		}
+		if interrupted {
+			fmt.Fprintf(&b, "printf '%s'; ", transcript.InterruptLine)
+		}
+		fmt.Fprintf(&b, "kill -%s -$__verify_pid; wait $__verify_pid; __verify_status=$?\n", signal)
+		if text := lastLine(after); interrupted && text != "" {
+			fmt.Fprintf(&b, "__verify_await %s $__verify_off %s %d\n", shellQuote(output), shellQuote(text), interruptDone)
+		}
+		fmt.Fprintf(&b, "(exit $__verify_status)\n")
+	case step.Background() && len(h.Ports) > 0:
+		fmt.Fprintf(&b, "%s\n__verify_pid=$!\n", command)
+		for _, port := range h.Ports {
+			fmt.Fprintf(&b, "__verify_listen %d $__verify_pid\n", port)
+		}
+		fmt.Fprintf(&b, "true\n")
+	default:
+		fmt.Fprintf(&b, "%s\n", command)
+	}
+	if e.Stdin != "" {
+		fmt.Fprintf(&b, "__status=$?; exec 0<&3 3<&-; (exit $__status)\n")
+	}
+	return b.String()
+}
+
+// leakMarker and leakEnd enclose the stacks of the goroutines an instrumented
+// example leaves running.
+const (
+	leakMarker = "__verify_leaks"
+	leakEnd    = "__verify_leaks_end"
+)
+
+// leakCheck is added to an instrumented example and deferred by its main. It
+// gives the goroutines that the example started a second to finish, then
+// prints the stacks of those still running. Goroutines of the standard
+// library, like those of signal.Notify or of idle HTTP connections, aren't
+// the example's doing.
+const leakCheck = `
+func __verify_leaks() {
+	for i := 0; i < 100; i++ {
+		buf := make([]byte, 1<<20)
+		all := __verify_strings.Split(string(buf[:__verify_runtime.Stack(buf, true)]), "\n\n")
+		var running []string
+		for _, g := range all[1:] {
+			if __verify_strings.Contains(g, "\nmain.") || __verify_strings.Contains(g, "\ncreated by main.") {
+				running = append(running, __verify_strings.TrimSpace(g))
+			}
+		}
+		if len(running) == 0 {
+			return
+		}
+		if i == 99 {
+			__verify_os.Stderr.WriteString("` + leakMarker + `\n" + __verify_strings.Join(running, "\n\n") + "\n` + leakEnd + `\n")
+		}
+		__verify_time.Sleep(10 * __verify_time.Millisecond)
+	}
+}
+`
+
+// instrumentMain makes the main function of an example's source, if it has
+// one, check for goroutines left running when it returns. The additions are
+// made at the end of existing lines, so line numbers in panics and race
+// reports stay those of the example. Examples that exit through os.Exit or a
+// panic aren't checked.
+func instrumentMain(name string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, 0)
+	if err != nil {
+		return nil, err
+	}
+	body := -1
+	for _, decl := range f.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && fn.Name.Name == "main" && fn.Body != nil {
+			body = fset.Position(fn.Body.Lbrace).Offset + 1
+		}
+	}
+	if f.Name.Name != "main" || body < 0 {
+		return src, nil
+	}
+	pkg := fset.Position(f.Name.End()).Offset
+	var b bytes.Buffer
+	b.Write(src[:pkg])
+	b.WriteString(`; import (__verify_os "os"; __verify_runtime "runtime"; __verify_strings "strings"; __verify_time "time")`)
+	b.Write(src[pkg:body])
+	b.WriteString(" defer __verify_leaks();")
+	b.Write(src[body:])
+	b.WriteString(leakCheck)
+	return b.Bytes(), nil
+}
+
+// splitLeaks separates the report of an instrumented example from its output,
+// returning the stacks of the goroutines it left running.
+func splitLeaks(lines []string) (output []string, stacks []string) {
+	var stack []string
+	in := false
+	for _, line := range lines {
+		switch {
+		case line == leakMarker:
+			in = true
+		case line == leakEnd:
+			in = false
+		case !in:
+			output = append(output, line)
+		case line == "":
+			stacks = append(stacks, strings.Join(stack, "\n"))
+			stack = nil
+		default:
+			stack = append(stack, line)
+		}
+		if line == leakEnd && len(stack) > 0 {
+			stacks = append(stacks, strings.Join(stack, "\n"))
+			stack = nil
+		}
+	}
+	return output, stacks
+}
+
+// unexpectedLeaks returns the stacks that match none of allowed.
+func unexpectedLeaks(stacks []string, allowed []*regexp.Regexp) []string {
+	var unexpected []string
+	for _, stack := range stacks {
+		ok := false
+		for _, leak := range allowed {
+			ok = ok || leak.MatchString(stack)
+		}
+		if !ok {
+			unexpected = append(unexpected, stack)
+		}
+	}
+	return unexpected
+}
+
+var stackOffsetPat = regexp.MustCompile(` \+0x[0-9a-f]+$`)
+
+// groupStacks lists goroutines with the same stack, like the workers of a
+// pool, once, noting how many more there are.
+func groupStacks(stacks []string) []string {
+	var groups []string
+	count := make(map[string]int)
+	first := make(map[string]int)
+	for _, stack := range stacks {
+		lines := strings.Split(stack, "\n")
+		for i := range lines {
+			lines[i] = stackOffsetPat.ReplaceAllString(lines[i], "")
+		}
+		key := strings.Join(lines[1:], "\n") // without "goroutine N [state]:"
+		if _, ok := first[key]; !ok {
+			first[key] = len(groups)
+			groups = append(groups, stack)
+		}
+		count[key]++
+	}
+	for key, i := range first {
+		if n := count[key] - 1; n > 0 {
+			header, rest := groups[i], ""
+			if j := strings.Index(header, "\n"); j >= 0 {
+				header, rest = header[:j], header[j+1:]
+			}
+			groups[i] = fmt.Sprintf("%s (and %d more like it)\n%s", header, n, rest)
+		}
+	}
+	return groups
+}
+
+// raceSeparator delimits the reports of the race detector.
+const raceSeparator = "=================="
+
+// splitRaces separates the reports of the race detector from an output, along
+// with its closing "Found N data race(s)" and the exit status go run prints
+// for it.
+func splitRaces(lines []string) (output []string, reports []string) {
+	var report []string
+	in := false
+	for i, line := range lines {
+		switch {
+		case line == raceSeparator && !in && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "WARNING: DATA RACE"):
+			in = true
+		case line == raceSeparator && in:
+			reports = append(reports, strings.Join(report, "\n"))
+			report, in = nil, false
+		case in:
+			report = append(report, line)
+		case len(reports) > 0 && (strings.HasPrefix(line, "Found ") && strings.HasSuffix(line, "data race(s)") || line == "exit status 66"):
+		default:
+			output = append(output, line)
+		}
+	}
+	return output, reports
+}
+
+// runSteps runs the commands of steps in one bash session in dir, with their
+// paths in /tmp rewritten to tmp. After each
+// command the session prints a marker with the command's exit status, which
+// separates the outputs of the commands.
+func runSteps(ctx context.Context, dir, tmp string, steps []transcript.Step, h Harness, env []string) ([]Result, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	marker := "__verify_" + hex.EncodeToString(nonce)
+
+	// Output goes to a file rather than a pipe, so that processes left running
+	// in the background can't keep the session from finishing.
+	out, err := os.CreateTemp("", "gobyexample-verify-out-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	pgids, err := os.CreateTemp("", "gobyexample-verify-pgids-")
+	if err != nil {
+		return nil, err
+	}
+	pgids.Close()
+	defer os.Remove(pgids.Name())
+
+	var script strings.Builder
+	script.WriteString(sessionFuncs)
+	for _, step := range steps {
+		script.WriteString(stepScript(step, h, tmp, out.Name(), pgids.Name()))
+		// Restore $? so that a following `echo $?` sees the command's status.
+		fmt.Fprintf(&script, "__status=$?; printf '\\n%s %%d\\n' $__status; (exit $__status)\n", marker)
+	}
+
+	// The session reads the script from a file, leaving its standard input
+	// for the commands: nothing, unless a stdin directive gives them a file.
+	scriptFile, err := os.CreateTemp("", "gobyexample-verify-script-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(scriptFile.Name())
+	_, err = scriptFile.WriteString(script.String())
+	if closeErr := scriptFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("bash", "--noprofile", "--norc", scriptFile.Name())
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	// Kill the whole process group when done, including anything the
+	// transcript started in the background, and the jobs of interrupted
+	// commands.
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		data, _ := os.ReadFile(pgids.Name())
+		for _, field := range strings.Fields(string(data)) {
+			if pgid, err := strconv.Atoi(field); err == nil {
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var runErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		runErr = ctx.Err()
+	}
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		return nil, err
+	}
+	return splitResults(string(data), marker), runErr
+}
+
+// sessionEnv is the environment of a transcript session: enough to find and
+// run the go command, but nothing else of ours that examples listing the
+// environment would print. With a stand-in proxy, HTTP requests go to it
+// instead of the network.
+func sessionEnv(proxy string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		switch {
+		case name == "PATH", name == "HOME", strings.HasPrefix(name, "GO"):
+			env = append(env, kv)
+		}
+	}
+	if proxy != "" {
+		env = append(env, "HTTP_PROXY="+proxy, "HTTPS_PROXY="+proxy, "NO_PROXY=localhost,127.0.0.1")
+	}
+	return env
+}
+
+// standIn is the proxy that answers an example's requests for the hosts of
+// its harness.
+type standIn map[string]http.Handler
+
+func newStandIn(hosts map[string]string) standIn {
+	s := make(standIn)
+	for name, dir := range hosts {
+		s[name] = http.FileServer(http.Dir(dir))
+	}
+	return s
+}
+
+func (s standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if host == "" {
+		host = r.Host
+	}
+	h, ok := s[host]
+	if !ok || r.Method == http.MethodConnect {
+		http.Error(w, "verify: no stand-in for "+r.Host, http.StatusBadGateway)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// startStandIn serves s on a local port and returns its URL.
+func startStandIn(s standIn) (url string, stop func(), err error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	srv := &http.Server{Handler: s}
+	go srv.Serve(ln)
+	return "http://" + ln.Addr().String(), func() { srv.Close() }, nil
+}
+
+// portLocks serializes the transcripts whose examples listen on a port.
+var portLocks = struct {
+	sync.Mutex
+	ports map[int]*sync.Mutex
+}{ports: make(map[int]*sync.Mutex)}
+
+// lockPorts waits until no other transcript uses ports and returns a function
+// releasing them.
+func lockPorts(ports []int) (unlock func()) {
+	ports = append([]int(nil), ports...)
+	sort.Ints(ports) // a fixed order avoids deadlocks
+	var locks []*sync.Mutex
+	for _, port := range ports {
+		portLocks.Lock()
+		l := portLocks.ports[port]
+		if l == nil {
+			l = new(sync.Mutex)
+			portLocks.ports[port] = l
+		}
+		portLocks.Unlock()
+		l.Lock()
+		locks = append(locks, l)
+	}
+	return func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}
+}
+
+// portFree reports whether port can be listened on, giving a server killed by
+// the previous transcript a moment to release it. Otherwise the example would
+// be verified against whatever else is listening there.
+func portFree(port int) bool {
+	for i := 0; i < 20; i++ {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			ln.Close()
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
+}
+
+// breakInterrupt puts the output that follows the ^C of an interrupted command
+// on a line of its own. The terminal echoes ^C without a newline, and the
+// transcript shows what came after on the next line whether it was the
+// program that printed the newline or the shell.
+func breakInterrupt(lines []string) []string {
+	for i, line := range lines {
+		if line == transcript.InterruptLine {
+			break
+		}
+		if strings.HasPrefix(line, transcript.InterruptLine) {
+			out := append([]string(nil), lines[:i]...)
+			out = append(out, transcript.InterruptLine, strings.TrimPrefix(line, transcript.InterruptLine))
+			return append(out, lines[i+1:]...)
+		}
+	}
+	return lines
+}
+
+// splitResults cuts the output of a session at its markers. Output after the
+// last marker belongs to a command that didn't finish.
+func splitResults(output, marker string) []Result {
+	var results []Result
+	for {
+		i := strings.Index(output, "\n"+marker+" ")
+		if i < 0 {
+			break
+		}
+		rest := output[i+len(marker)+2:]
+		end := strings.Index(rest, "\n")
+		if end < 0 {
+			end = len(rest)
+		}
+		status, _ := strconv.Atoi(rest[:end])
+		results = append(results, Result{
+			Output: transcript.TrimOutput(strings.Split(output[:i], "\n")),
+			Status: status,
+		})
+		output = strings.TrimPrefix(rest[end:], "\n")
+	}
+	if output != "" {
+		results = append(results, Result{Output: transcript.TrimOutput(strings.Split(output, "\n")), Status: -1})
+	}
+	return results
+}
+
+// Report is what verifying one transcript found.
+type Report struct {
+	Example    string
+	Transcript string
+	Problems   []string
+	Updated    bool // the transcript was rewritten with the actual output
+	Elapsed    time.Duration
+}
+
+// options are the flags that affect how transcripts are verified.
+type options struct {
+	timeout time.Duration
+	update  bool
+	race    bool
+	leaks   bool
+}
+
+// verifyTranscript runs the transcript at path. With update, it rewrites the
+// output of the commands that print something else, unless they also exit
+// with a status they shouldn't, which points at a broken example or command
+// rather than a changed one. Data races, and with leaks goroutines left
+// running, are reported instead of the output of the command they happen in.
+// With race, output isn't compared at all, as the race detector slows the
+// examples down enough to change what those that time themselves print.
+func verifyTranscript(id, path string, opts options) (report Report) {
+	start := time.Now()
+	report = Report{Example: id, Transcript: path}
+	defer func() { report.Elapsed = time.Since(start) }()
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+	steps := transcript.Parse(string(src))
+	if len(steps) == 0 {
+		return report
+	}
+	h, err := loadHarness(path)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+	// Directives about commands the transcript doesn't have are most likely
+	// stale, and would otherwise go unnoticed.
+	for command, e := range h.Commands {
+		found := false
+		for _, step := range steps {
+			found = found || step.Command == command
+		}
+		if !found {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s:%d: no command %q in %s", harnessPath(path), e.Line, command, path))
+		}
+	}
+	if len(report.Problems) > 0 {
+		return report
+	}
+	if len(h.Ports) > 0 {
+		defer lockPorts(h.Ports)()
+		for _, port := range h.Ports {
+			if !portFree(port) {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s: port %d is in use", path, port))
+				return report
+			}
+		}
+	}
+	var proxy string
+	if len(h.Hosts) > 0 {
+		var stop func()
+		proxy, stop, err = startStandIn(newStandIn(h.Hosts))
+		if err != nil {
+			report.Problems = append(report.Problems, err.Error())
+			return report
+		}
+		defer stop()
+	}
+
+	root, dir, tmp, err := newWorkspace(id, opts.leaks)
+	defer os.RemoveAll(root)
+	if err != nil {
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.timeout)
+	defer cancel()
+	// go run's builds go in the workspace too, as a server killed at the end of
+	// the session doesn't get to remove its own, and so do the examples'
+	// temporary files.
+	env := append(sessionEnv(proxy), "GOTMPDIR="+root, "TMPDIR="+tmp)
+	if opts.race {
+		env = append(env, strings.TrimSpace("GOFLAGS="+os.Getenv("GOFLAGS")+" -race"))
+	}
+	results, err := runSteps(ctx, dir, tmp, steps, h, env)
+	timedOut := errors.Is(err, context.DeadlineExceeded)
+	if err != nil && !timedOut {
+		report.Problems = append(report.Problems, err.Error())
+		return report
+	}
+	outputs := make(map[int][]transcript.OutputLine) // by step, with update
+	for i, step := range steps {
+		if i >= len(results) || results[i].Status == -1 {
+			// Only the first unfinished command was still running.
+			if timedOut {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s:%d: $ %s: timed out after %v", path, step.Line, step.Command, opts.timeout))
+			}
+			break
+		}
+		result := results[i]
+		// Output shows the paths in /tmp that the transcript does.
+		for k, line := range result.Output {
+			result.Output[k] = strings.ReplaceAll(line, tmp+"/", "/tmp/")
+		}
+		if _, _, ok := step.Interrupt(); ok {
+			result.Output = breakInterrupt(result.Output)
+		}
+		// Reports refer to the example's files rather than their copies.
+		examplePaths := strings.NewReplacer(dir+string(filepath.Separator), filepath.Join("examples", id)+string(filepath.Separator))
+		var races, leaks []string
+		result.Output, races = splitRaces(result.Output)
+		result.Output, leaks = splitLeaks(result.Output)
+		if len(races) > 0 {
+			problem := fmt.Sprintf("%s:%d: $ %s: %d data race(s)", path, step.Line, step.Command, len(races))
+			for _, race := range races {
+				problem += "\n\n" + examplePaths.Replace(race)
+			}
+			report.Problems = append(report.Problems, problem)
+			continue
+		}
+		if leaks = unexpectedLeaks(leaks, h.Leaks); len(leaks) > 0 {
+			problem := fmt.Sprintf("%s:%d: $ %s: %d goroutine(s) still running when main returned", path, step.Line, step.Command, len(leaks))
+			for _, leak := range groupStacks(leaks) {
+				problem += "\n\n" + examplePaths.Replace(leak)
+			}
+			report.Problems = append(report.Problems, problem)
+		}
+		rules := h.Rules
+		if isGoTest(step.Command) {
+			if failed := failedTests(result.Output); len(failed) > 0 {
+				report.Problems = append(report.Problems, fmt.Sprintf("%s:%d: $ %s: %s failed\n%s",
+					path, step.Line, step.Command, strings.Join(failed, ", "), strings.Join(result.Output, "\n")))
+				continue
+			}
+			rules = append(append([]transcript.Rule(nil), goTestRules...), rules...)
+		}
+		want, got := transcript.Normalize(step.Output, rules), transcript.Normalize(result.Output, rules)
+		e := h.expectFor(step.Command)
+		if status, ok := recordedStatus(steps, i); ok && len(e.Statuses) == 0 {
+			e.Statuses = []int{status}
+		}
+		switch {
+		case opts.update && !transcript.Match(want, got) && e.allows(result.Status):
+			outputs[i] = transcript.Update(step.Output, result.Output, rules)
+		case !opts.race && !transcript.Match(want, got):
+			problem := fmt.Sprintf("%s:%d: $ %s: output differs", path, step.Line, step.Command)
+			if result.Status != 0 {
+				problem += fmt.Sprintf(" (exit status %d)", result.Status)
+			}
+			problem += "\n" + textdiff.Unified("transcript", "actual", want, got)
+			report.Problems = append(report.Problems, problem)
+		case !e.allows(result.Status):
+			report.Problems = append(report.Problems, fmt.Sprintf("%s:%d: $ %s: exit status %d, want %s",
+				path, step.Line, step.Command, result.Status, e.statusList()))
+		}
+	}
+
+	if len(outputs) > 0 {
+		// Output the transcript can't show differently, like a blank line
+		// before commentary, leaves it as it was.
+		if updated := transcript.Rewrite(string(src), steps, outputs); updated != string(src) {
+			if err := os.WriteFile(path, []byte(updated), 0644); err != nil {
+				report.Problems = append(report.Problems, err.Error())
+				return report
+			}
+			report.Updated = true
+		}
+	}
+	return report
+}
+
+// transcripts returns the .sh files of an example; translated transcripts
+// (x.sh.zh) only differ in their commentary.
+func transcripts(id string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join("examples", id, "*.sh"))
+	sort.Strings(paths)
+	return paths, err
+}
+
+func main() {
+	verbose := flag.Bool("v", false, "also list the transcripts that match")
+	jobs := flag.Int("j", runtime.NumCPU(), "number of transcripts verified in parallel")
+	timeout := flag.Duration("timeout", 2*time.Minute, "time limit for running one transcript")
+	update := flag.Bool("update", false, "rewrite the output recorded in transcripts that differs from the actual output")
+	race := flag.Bool("race", false, "build and run the examples with the race detector")
+	leaks := flag.Bool("leaks", false, "report goroutines that examples leave running when main returns")
+	flag.Parse()
+	opts := options{timeout: *timeout, update: *update, race: *race, leaks: *leaks}
+	if *jobs < 1 {
+		fmt.Fprintf(os.Stderr, "-j must be at least 1, got %d\n", *jobs)
+		os.Exit(2)
+	}
+	if opts.update && opts.race {
+		fmt.Fprintln(os.Stderr, "-update can't be used with -race, which doesn't compare output")
+		os.Exit(2)
+	}
+
+	ids, err := examplelist.IDs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if flag.NArg() > 0 {
+		known := make(map[string]bool)
+		for _, id := range ids {
+			known[id] = true
+		}
+		for _, id := range flag.Args() {
+			if !known[id] {
+				fmt.Fprintf(os.Stderr, "unknown example %q\n", id)
+				os.Exit(2)
+			}
+		}
+		ids = flag.Args()
+	}
+
+	type job struct{ id, path string }
+	var queue []job
+	untested := make(map[string]string) // example -> problem
+	for _, id := range ids {
+		paths, err := transcripts(id)
+		if err == nil {
+			var missing []string
+			missing, err = missingTestRuns(id, paths)
+			if len(missing) > 0 {
+				untested[id] = fmt.Sprintf("examples/%s has tests, but no transcript runs %s", id, strings.Join(missing, " or "))
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, path := range paths {
+			queue = append(queue, job{id, path})
+		}
+	}
+
+	// Transcripts run in parallel but are reported in examples.txt order.
+	reports := make([]Report, len(queue))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *jobs)
+	for i, j := range queue {
+		wg.Add(1)
+		go func(i int, j job) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			reports[i] = verifyTranscript(j.id, j.path, opts)
+		}(i, j)
+	}
+	wg.Wait()
+	// An example's tests not being run is reported with its first transcript.
+	for i := range reports {
+		if problem, ok := untested[reports[i].Example]; ok {
+			reports[i].Problems = append([]string{problem}, reports[i].Problems...)
+			delete(untested, reports[i].Example)
+		}
+	}
+	for _, id := range ids {
+		if problem, ok := untested[id]; ok {
+			reports = append(reports, Report{Example: id, Transcript: filepath.Join("examples", id), Problems: []string{problem}})
+		}
+	}
+
+	failed, updated := 0, 0
+	for _, r := range reports {
+		if r.Updated {
+			updated++
+			fmt.Printf("updated %s\n", r.Transcript)
+		}
+		if len(r.Problems) == 0 {
+			if *verbose {
+				fmt.Printf("ok    %s (%.1fs)\n", r.Transcript, r.Elapsed.Seconds())
+			}
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL  %s (%.1fs)\n", r.Transcript, r.Elapsed.Seconds())
+		for _, problem := range r.Problems {
+			fmt.Println(indent(problem))
+		}
+	}
+	if *update {
+		fmt.Printf("%d transcripts, %d updated, %d failed\n", len(reports), updated, failed)
+	} else {
+		fmt.Printf("%d transcripts, %d failed\n", len(reports), failed)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func indent(s string) string {
+	var b bytes.Buffer
+	for _, line := range strings.Split(strings.TrimRight(s, "\n"), "\n") {
+		b.WriteString("    " + line + "\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}